@@ -0,0 +1,103 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// walkRound is the number of directories, which WatchAsync adds to the tree
+// at once, before it releases the tree lock for a moment.
+const walkRound = 256
+
+// progress tracks a recursive Watch call started by WatchAsync. A nil progress
+// belongs to a synchronous Watch call.
+type progress struct {
+	ctx     context.Context // cancelled when the channel is stopped
+	walked  atomic.Int64    // directories read
+	watched atomic.Int64    // directories watched
+}
+
+// err reports whether the setup was cancelled.
+func (pr *progress) err() error {
+	if pr == nil {
+		return nil
+	}
+	return pr.ctx.Err()
+}
+
+func (pr *progress) walk() {
+	if pr != nil {
+		pr.walked.Add(1)
+	}
+}
+
+// counting wraps fn, so that it counts the directories it watched.
+func (pr *progress) counting(fn walkFunc) walkFunc {
+	if pr == nil {
+		return fn
+	}
+	return func(nd node) error {
+		err := fn(nd)
+		if err == nil {
+			pr.watched.Add(1)
+		}
+		return err
+	}
+}
+
+// Setup is a watchpoint set up in the background by WatchAsync. Its counters
+// stay zero for watchers, which watch whole trees natively, as no directories
+// are walked then.
+type Setup struct {
+	pr     progress
+	ready  chan struct{}
+	err    error
+	cancel context.CancelFunc
+}
+
+// Ready gives a channel, which is closed once the setup is finished, either
+// successfully or not. Events are sent to the channel of the watchpoint as
+// soon as Ready is closed, some of them may be sent before.
+func (s *Setup) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Walked gives the number of directories read so far.
+func (s *Setup) Walked() int {
+	return int(s.pr.walked.Load())
+}
+
+// Watched gives the number of directories watched so far.
+func (s *Setup) Watched() int {
+	return int(s.pr.watched.Load())
+}
+
+// Err gives the error of the setup, as it would be returned by WatchWith. It
+// is nil until Ready is closed. If the channel was stopped before the setup
+// finished, it is context.Canceled.
+func (s *Setup) Err() error {
+	select {
+	case <-s.ready:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// pending is the proxy of a Setup, which cancels it when its channel is
+// stopped.
+type pending struct {
+	*Setup
+	stop func() // stops proxies added by the setup
+}
+
+// Stop implements proxy.
+func (p *pending) Stop() {
+	p.cancel()
+	<-p.ready
+	p.stop()
+}
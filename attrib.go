@@ -0,0 +1,231 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WriteKind tells how a Write event changed the content of a file.
+type WriteKind uint8
+
+const (
+	// WriteUnknown is reported when the previous size of the file is not known.
+	WriteUnknown WriteKind = iota
+	// WriteAppend is reported when the file grew.
+	WriteAppend
+	// WriteTruncate is reported when the file shrank.
+	WriteTruncate
+	// WriteOverwrite is reported when the size of the file did not change.
+	WriteOverwrite
+)
+
+var wkstr = [...]string{
+	WriteUnknown:   "notify.WriteUnknown",
+	WriteAppend:    "notify.WriteAppend",
+	WriteTruncate:  "notify.WriteTruncate",
+	WriteOverwrite: "notify.WriteOverwrite",
+}
+
+// String implements fmt.Stringer interface.
+func (k WriteKind) String() string {
+	if int(k) < len(wkstr) {
+		return wkstr[k]
+	}
+	return wkstr[WriteUnknown]
+}
+
+// Changer is implemented by metadata change and Write events sent for paths
+// watched for any of the Attrib events.
+type Changer interface {
+	// Change gives the state of the file cached before the event and the one
+	// read right after it. The former is nil if it was not known, the latter
+	// is nil if the file no longer exists.
+	Change() (old, new os.FileInfo)
+	// WriteKind tells how a Write event changed the file. It is WriteUnknown
+	// for other events.
+	WriteKind() WriteKind
+}
+
+// change is the result of comparing the cached state of a file with the
+// current one.
+type change struct {
+	event Event
+	old   os.FileInfo
+	new   os.FileInfo
+	kind  WriteKind
+}
+
+// changeEvent is an EventInfo narrowed down with help of the stat cache.
+type changeEvent struct{ *matched }
+
+var _ Changer = changeEvent{}
+
+func (e changeEvent) Change() (os.FileInfo, os.FileInfo) { return e.ch.old, e.ch.new }
+func (e changeEvent) WriteKind() WriteKind               { return e.ch.kind }
+
+// statChangeEvent is a changeEvent with a stat snapshot attached.
+type statChangeEvent struct{ *matched }
+
+var (
+	_ Stater  = statChangeEvent{}
+	_ Changer = statChangeEvent{}
+)
+
+func (e statChangeEvent) Stat() (os.FileInfo, error)         { return e.st.fi, e.st.err }
+func (e statChangeEvent) Change() (os.FileInfo, os.FileInfo) { return e.ch.old, e.ch.new }
+func (e statChangeEvent) WriteKind() WriteKind               { return e.ch.kind }
+
+// statCache keeps the last known state of files, which are watched for
+// metadata changes.
+type statCache struct {
+	mu sync.Mutex // protects fi
+	fi map[string]os.FileInfo
+}
+
+func newStatCache() *statCache {
+	return &statCache{fi: make(map[string]os.FileInfo)}
+}
+
+func (sc *statCache) set(path string, fi os.FileInfo) (old os.FileInfo) {
+	sc.mu.Lock()
+	old = sc.fi[path]
+	if fi != nil {
+		sc.fi[path] = fi
+	} else {
+		delete(sc.fi, path)
+	}
+	sc.mu.Unlock()
+	return old
+}
+
+// setnew caches the state of the path, unless it is already known. Update may
+// have cached a more recent state in the meantime.
+func (sc *statCache) setnew(path string, fi os.FileInfo) {
+	sc.mu.Lock()
+	if _, ok := sc.fi[path]; !ok {
+		sc.fi[path] = fi
+	}
+	sc.mu.Unlock()
+}
+
+// Prime caches the state of the path and, if it is a directory, the state
+// of its children. If isrec is true, the whole subtree gets cached. It walks
+// the file system, thus it is called without the tree lock held, after the
+// watches were set, so no change goes unnoticed.
+func (sc *statCache) Prime(path string, isrec bool, doNotWatch DoNotWatchFn) {
+	fn := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != path && doNotWatch != nil && doNotWatch(p) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		sc.setnew(p, fi)
+		if fi.IsDir() && p != path && !isrec {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	filepath.Walk(path, fn)
+}
+
+// Prune drops the state of files for which keep returns false.
+func (sc *statCache) Prune(keep func(path string) bool) {
+	sc.mu.Lock()
+	for path := range sc.fi {
+		if !keep(path) {
+			delete(sc.fi, path)
+		}
+	}
+	sc.mu.Unlock()
+}
+
+// Update refreshes the cached state of the file described by ei. If ei is
+// a metadata change or a Write event, Update narrows it down by comparing
+// the cached state with the current one.
+func (sc *statCache) Update(ei EventInfo) EventInfo {
+	switch e := ei.Event(); e {
+	case Remove, Rename:
+		sc.mu.Lock()
+		prefix := ei.Path() + sep
+		for path := range sc.fi {
+			if path == ei.Path() || strings.HasPrefix(path, prefix) {
+				delete(sc.fi, path)
+			}
+		}
+		sc.mu.Unlock()
+	case Create, Write, Attrib:
+		fi, _ := os.Lstat(ei.Path())
+		old := sc.set(ei.Path(), fi)
+		switch e {
+		case Write:
+			ch := &change{event: e, old: old, new: fi, kind: writeKind(old, fi)}
+			return &matched{EventInfo: ei, ch: ch}
+		case Attrib:
+			ch := &change{event: attribKind(old, fi), old: old, new: fi}
+			return &matched{EventInfo: ei, ch: ch}
+		}
+	}
+	return ei
+}
+
+func writeKind(old, new os.FileInfo) WriteKind {
+	switch {
+	case old == nil || new == nil:
+		return WriteUnknown
+	case new.Size() > old.Size():
+		return WriteAppend
+	case new.Size() < old.Size():
+		return WriteTruncate
+	default:
+		return WriteOverwrite
+	}
+}
+
+func attribKind(old, new os.FileInfo) Event {
+	if old == nil || new == nil || old.Mode() != new.Mode() {
+		return Chmod
+	}
+	ouid, ogid, onlink, ook := owner(old)
+	nuid, ngid, nnlink, nok := owner(new)
+	switch {
+	case ook && nok && (ouid != nuid || ogid != ngid):
+		return Chown
+	case !old.ModTime().Equal(new.ModTime()):
+		return Touch
+	case ook && nok && onlink != nnlink:
+		return Chmod
+	default:
+		return Xattr
+	}
+}
+
+// wantsAttrib reports whether any watchpoint set on the path, its parent or
+// its ancestors listens for metadata changes.
+func wantsAttrib(r root, path string) (ok bool) {
+	var nd node
+	dir, base := split(path)
+	fn := func(it node, isbase bool) error {
+		if isbase {
+			nd = it
+		}
+		ok = ok || it.Watch.Total()&Attrib != 0
+		return nil
+	}
+	if err := r.WalkPath(dir, fn); err != nil {
+		return ok
+	}
+	if nd, found := nd.Child[base]; found {
+		ok = ok || nd.Watch.Total()&Attrib != 0
+	}
+	return ok
+}
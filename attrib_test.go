@@ -0,0 +1,97 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fileInfo struct {
+	os.FileInfo
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func TestWriteKind(t *testing.T) {
+	cases := [...]struct {
+		old, new os.FileInfo
+		kind     WriteKind
+	}{
+		{nil, fileInfo{size: 1}, WriteUnknown},
+		{fileInfo{size: 1}, nil, WriteUnknown},
+		{fileInfo{size: 1}, fileInfo{size: 2}, WriteAppend},
+		{fileInfo{size: 2}, fileInfo{size: 1}, WriteTruncate},
+		{fileInfo{size: 2}, fileInfo{size: 2}, WriteOverwrite},
+	}
+	for i, cas := range cases {
+		if kind := writeKind(cas.old, cas.new); kind != cas.kind {
+			t.Errorf("want kind=%v; got %v (i=%d)", cas.kind, kind, i)
+		}
+	}
+}
+
+func TestAttribKind(t *testing.T) {
+	now := time.Now()
+	cases := [...]struct {
+		old, new os.FileInfo
+		e        Event
+	}{
+		{nil, fileInfo{mode: 0644}, Chmod},
+		{fileInfo{mode: 0644}, nil, Chmod},
+		{fileInfo{mode: 0644}, fileInfo{mode: 0600}, Chmod},
+		{fileInfo{mode: 0644, mtime: now}, fileInfo{mode: 0644, mtime: now.Add(time.Second)}, Touch},
+		{fileInfo{mode: 0644, mtime: now}, fileInfo{mode: 0644, mtime: now}, Xattr},
+	}
+	for i, cas := range cases {
+		if e := attribKind(cas.old, cas.new); e != cas.e {
+			t.Errorf("want e=%v; got %v (i=%d)", cas.e, e, i)
+		}
+	}
+}
+
+func TestStatCacheUpdate(t *testing.T) {
+	sc := newStatCache()
+	sc.set("/a", fileInfo{})
+	sc.set("/a/b", fileInfo{})
+	sc.set("/a/b/c", fileInfo{})
+	sc.set("/ab", fileInfo{})
+
+	sc.Update(&Call{P: "/a/b", E: Remove})
+	for path, ok := range map[string]bool{"/a": true, "/a/b": false, "/a/b/c": false, "/ab": true} {
+		if _, found := sc.fi[path]; found != ok {
+			t.Errorf("want %s cached=%v; got %v", path, ok, found)
+		}
+	}
+	sc.Prune(func(path string) bool { return path != "/a" })
+	if _, found := sc.fi["/a"]; found {
+		t.Error("want /a to be pruned")
+	}
+}
+
+func TestStatCachePrime(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	sc := newStatCache()
+	// The state cached by Update in the meantime is more recent.
+	newer := fileInfo{mode: 0600}
+	sc.set(file, newer)
+	sc.Prime(dir, false, nil)
+	if _, found := sc.fi[dir]; !found {
+		t.Errorf("want %s to be cached", dir)
+	}
+	if fi := sc.fi[file]; fi != os.FileInfo(newer) {
+		t.Errorf("want %s state to be kept; got %v", file, fi)
+	}
+}
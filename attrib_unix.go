@@ -0,0 +1,33 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"os"
+	"syscall"
+)
+
+// owner gives the owner, group and link count of a file, ok is false if fi
+// does not carry such information.
+func owner(fi os.FileInfo) (uid, gid uint32, nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return st.Uid, st.Gid, uint64(st.Nlink), true
+}
+
+// inode gives the inode number of a file, ok is false if fi does not carry
+// such information.
+func inode(fi os.FileInfo) (ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package notify
+
+import "os"
+
+// owner is not supported on Windows, file ownership is not a part of
+// os.FileInfo there.
+func owner(os.FileInfo) (uid, gid uint32, nlink uint64, ok bool) {
+	return
+}
+
+// inode is not supported on Windows, file indexes are not a part of
+// os.FileInfo there.
+func inode(os.FileInfo) (ino uint64, ok bool) {
+	return
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+// NotifyOption configures a Notify instance, see NewNotify.
+type NotifyOption func(*config)
+
+// config holds the settings of a Notify instance.
+type config struct {
+	workers int // see WithDispatchWorkers
+	queue   int // see WithDispatchQueue
+}
+
+// newConfig gives the config with the options applied. Zero fields mean the
+// defaults.
+func newConfig(opts []NotifyOption) (cfg config) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithDispatchWorkers sets the number of goroutines, which deliver events to
+// user channels. All events of a single channel are delivered by the same one
+// of them, in order. Non-positive n means the default of 8.
+//
+// The number of goroutines does not depend on the rate of events, as they are
+// looked up in the tree by a single goroutine, in batches.
+func WithDispatchWorkers(n int) NotifyOption {
+	return func(cfg *config) {
+		cfg.workers = n
+	}
+}
+
+// WithDispatchQueue sets the number of events, which can wait for each of the
+// dispatch workers. Once the queue of a worker is full, looking up further
+// events waits until it catches up. Non-positive n means the default of 128.
+func WithDispatchQueue(n int) NotifyOption {
+	return func(cfg *config) {
+		cfg.queue = n
+	}
+}
@@ -17,8 +17,13 @@ var dbgprintf func(string, ...interface{})
 
 var dbgcallstack func(max int) []string
 
+// dbgenabled reports whether debug output is enabled. It is checked on hot
+// paths, so that the arguments of dbgprintf are not allocated for nothing.
+var dbgenabled bool
+
 func init() {
 	if _, ok := os.LookupEnv("NOTIFY_DEBUG"); ok || debugTag {
+		dbgenabled = true
 		log.SetOutput(os.Stdout)
 		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 		dbgprint = func(v ...interface{}) {
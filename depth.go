@@ -0,0 +1,86 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import "strings"
+
+// depths holds the depth limits of recursive watchpoints, by the paths they
+// were set on and their channels. Channels without a limit are not stored.
+// It is guarded by the tree lock.
+type depths map[string]map[chan<- EventInfo]int
+
+// Set sets the depth limit of the recursive watchpoint of c set on root. If c
+// is already watching root, as reported by exists, the greater limit is kept.
+// Non-positive depth means no limit.
+func (d depths) Set(root string, c chan<- EventInfo, depth int, exists bool) {
+	lim, ok := d[root][c]
+	switch {
+	case depth <= 0 || (exists && !ok):
+		if ok {
+			delete(d[root], c)
+			if len(d[root]) == 0 {
+				delete(d, root)
+			}
+		}
+	case !ok || depth > lim:
+		if d[root] == nil {
+			d[root] = make(map[chan<- EventInfo]int)
+		}
+		d[root][c] = depth
+	}
+}
+
+// Unset removes the depth limit of c set on root.
+func (d depths) Unset(root string, c chan<- EventInfo) {
+	if lim, ok := d[root]; ok {
+		delete(lim, c)
+		if len(lim) == 0 {
+			delete(d, root)
+		}
+	}
+}
+
+// Del removes the depth limits of c.
+func (d depths) Del(c chan<- EventInfo) {
+	for root, lim := range d {
+		delete(lim, c)
+		if len(lim) == 0 {
+			delete(d, root)
+		}
+	}
+}
+
+// Filter gives a sendFunc, which drops events reported deeper below root than
+// the limit of the channel. The dir is the parent directory of the event.
+func (d depths) Filter(root, dir string, send sendFunc) sendFunc {
+	lim, ok := d[root]
+	if !ok {
+		return send
+	}
+	n := level(root, dir)
+	return func(c chan<- EventInfo, ei EventInfo) {
+		if depth, ok := lim[c]; ok && n > depth {
+			return
+		}
+		send(c, ei)
+	}
+}
+
+// maxdepth gives the greater of the depth limits, negative meaning no limit.
+func maxdepth(i, j int) int {
+	if i < 0 || j < 0 {
+		return -1
+	}
+	return max(i, j)
+}
+
+// level gives the number of directories between root and dir, which lies
+// within it.
+func level(root, dir string) int {
+	if root == dir {
+		return 0
+	}
+	return strings.Count(rel(root, dir), sep) + 1
+}
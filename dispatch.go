@@ -0,0 +1,151 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// dispatchWorkers is the default number of workers delivering events to user
+// channels, see WithDispatchWorkers.
+const dispatchWorkers = 8
+
+// dispatchBatch is the maximum number of events, which are looked up in the
+// tree at once, under a single read lock.
+const dispatchBatch = 64
+
+// batch receives an event from c, followed by the events already queued
+// behind it, up to cap(buf) of them. It reports false if c was closed or ctx
+// was cancelled before an event was received.
+func batch(ctx context.Context, c <-chan EventInfo, buf []EventInfo) ([]EventInfo, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case ei, ok := <-c:
+		if !ok {
+			return nil, false
+		}
+		buf = append(buf[:0], ei)
+	}
+	for len(buf) < cap(buf) {
+		select {
+		case ei, ok := <-c:
+			if !ok {
+				return buf, true
+			}
+			buf = append(buf, ei)
+		default:
+			return buf, true
+		}
+	}
+	return buf, true
+}
+
+// delivery is a single event addressed to a single user channel. A delivery
+// with non-nil done is a barrier - the worker closes done instead of sending.
+type delivery struct {
+	c    chan<- EventInfo
+	ei   EventInfo
+	done chan struct{}
+}
+
+// sendFunc hands ei over for delivery to the user channel c.
+type sendFunc func(c chan<- EventInfo, ei EventInfo)
+
+// dispatcher is a bounded pool of workers, which deliver events to user
+// channels. The pool is sharded by channel: every delivery for a given
+// channel is handled by the same worker, thus each channel receives events
+// in the order they were enqueued.
+type dispatcher struct {
+	ctx    context.Context
+	shards []chan delivery
+	wg     sync.WaitGroup
+}
+
+// newDispatcher creates a dispatcher with n workers, each of them with a queue
+// of the given size. Non-positive values mean the defaults.
+func newDispatcher(ctx context.Context, n, queue int) *dispatcher {
+	if n <= 0 {
+		n = dispatchWorkers
+	}
+	if queue <= 0 {
+		queue = buffer
+	}
+	d := &dispatcher{
+		ctx:    ctx,
+		shards: make([]chan delivery, n),
+	}
+	d.wg.Add(n)
+	for i := range d.shards {
+		d.shards[i] = make(chan delivery, queue)
+		go d.loop(d.shards[i])
+	}
+	return d
+}
+
+func (d *dispatcher) loop(shard <-chan delivery) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case dv := <-shard:
+			if dv.done != nil {
+				close(dv.done)
+				continue
+			}
+			select {
+			case dv.c <- dv.ei:
+			default: // Drop event if receiver is too slow
+				if dbgenabled {
+					dbgprintf("dropped %s on %q: receiver too slow", dv.ei.Event(), dv.ei.Path())
+				}
+			}
+		}
+	}
+}
+
+// shard gives the queue of the worker responsible for c.
+func (d *dispatcher) shard(c chan<- EventInfo) chan<- delivery {
+	p := reflect.ValueOf(c).Pointer()
+	p ^= p >> 16
+	return d.shards[(p>>4)%uintptr(len(d.shards))]
+}
+
+func (d *dispatcher) enqueue(dv delivery) bool {
+	select {
+	case d.shard(dv.c) <- dv:
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// Send enqueues ei for delivery to c. It blocks when the worker responsible
+// for c is saturated.
+func (d *dispatcher) Send(c chan<- EventInfo, ei EventInfo) {
+	d.enqueue(delivery{c: c, ei: ei})
+}
+
+// Flush blocks until every event enqueued for c before the call was either
+// delivered or dropped.
+func (d *dispatcher) Flush(c chan<- EventInfo) {
+	done := make(chan struct{})
+	if !d.enqueue(delivery{c: c, done: done}) {
+		return
+	}
+	select {
+	case <-done:
+	case <-d.ctx.Done():
+	}
+}
+
+// Wait blocks until all the workers exit, which happens after the context
+// the dispatcher was created with is cancelled.
+func (d *dispatcher) Wait() {
+	d.wg.Wait()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(ctx, dispatchWorkers, buffer)
+	defer d.Wait()
+	defer cancel()
+
+	ch := NewChans(4)
+	for i := 0; i < buffer; i++ {
+		for _, c := range ch {
+			d.Send(c, &Call{P: strconv.Itoa(i), E: Write})
+		}
+	}
+	for _, c := range ch {
+		d.Flush(c)
+	}
+	for j, c := range ch {
+		if n := len(c); n != buffer {
+			t.Fatalf("want len(ch[%d])=%d; got %d", j, buffer, n)
+		}
+		for i := 0; i < buffer; i++ {
+			if ei := <-c; ei.Path() != strconv.Itoa(i) {
+				t.Fatalf("want Path()=%d; got %s (j=%d)", i, ei.Path(), j)
+			}
+		}
+	}
+}
+
+func TestDispatcherDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(ctx, dispatchWorkers, buffer)
+	defer d.Wait()
+	defer cancel()
+
+	c := make(chan EventInfo, 1)
+	for i := 0; i < 3; i++ {
+		d.Send(c, &Call{P: strconv.Itoa(i), E: Write})
+	}
+	d.Flush(c)
+	if ei := <-c; ei.Path() != "0" {
+		t.Fatalf("want Path()=0; got %s", ei.Path())
+	}
+	if n := len(c); n != 0 {
+		t.Fatalf("want len(c)=0; got %d", n)
+	}
+}
+
+func TestDispatcherClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(ctx, 1, buffer)
+	cancel()
+	d.Wait()
+
+	c := make(chan EventInfo)
+	d.Send(c, &Call{P: "file", E: Write})
+	d.Flush(c)
+}
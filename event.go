@@ -6,7 +6,9 @@ package notify
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"time"
 )
 
 // Event represents the type of filesystem action.
@@ -31,6 +33,53 @@ const (
 	All = Create | Remove | Write | Rename
 )
 
+// Chmod, Chown, Touch and Xattr describe a change of metadata of a file.
+// Watchers report a metadata change as the Attrib value, which Notify narrows
+// down to a single event by comparing the state of the file with the one
+// cached before the change:
+//
+//   - Chmod, when file mode changed
+//   - Chown, when file owner or group changed
+//   - Touch, when file modification time changed
+//   - Xattr, when no stat(2) visible attribute changed, e.g. on setxattr(2)
+//
+// If the previous state of the file is not known, or only its link count
+// changed, the change is reported as Chmod.
+//
+// The values are present on all platforms. Under Windows ReadDirectoryChangesW
+// does not distinguish content changes from metadata ones, so a modification is
+// reported as a metadata change only if Write is not watched.
+const (
+	Chmod = osSpecificChmod
+	Chown = osSpecificChown
+	Touch = osSpecificTouch
+	Xattr = osSpecificXattr
+
+	// Attrib is handful alias for all metadata change event values.
+	Attrib = Chmod | Chown | Touch | Xattr
+)
+
+// WatchRemoved is sent when the underlying watcher stopped watching a path on
+// its own, e.g. because the path was deleted. The watchpoints set on the path
+// are removed and the event is sent to each channel, which lost one, regardless
+// of the requested event set. It is currently reported only by inotify.
+const WatchRemoved = osSpecificWatchRemoved
+
+// Synced is sent to a channel watched with the WithInitialScan option, after
+// the events of all the entries found by the initial scan were sent. Its path
+// is the path of the Watch call. It is sent regardless of the requested event
+// set and is never reported by the underlying watcher.
+const Synced = osSpecificSynced
+
+// WatchFailed is sent when a directory within a recursive watchpoint could
+// not be watched after several attempts, e.g. due to EMFILE or ENOSPC. It is
+// sent once to each channel watching the directory recursively, regardless
+// of the requested event set. Notify keeps retrying, so the directory may be
+// watched later on. The error can be retrieved with the Errorer interface.
+// See also Notify.Stats. It is also sent for the path of a WithPersistent
+// watchpoint, which could not be set up again after the path changed.
+const WatchFailed = osSpecificWatchFailed
+
 const internal = recursive | omit
 
 // String implements fmt.Stringer interface.
@@ -55,6 +104,14 @@ func (e Event) String() string {
 // For non-recursive watchpoints its base is always equal to the path passed
 // to corresponding Watch call.
 //
+// IsDir reports whether the event was reported for a directory, as told by the
+// underlying watcher. It does not touch the filesystem, so it remains valid for
+// paths which were already removed.
+//
+// Root gives the path of the Watch call, which the event was matched against,
+// and Rel gives Path relative to Root ("." if both are equal). Both paths are
+// in their canonical form, as described in the Watch documentation.
+//
 // The value of Sys if system-dependent and can be nil.
 //
 // # Sys
@@ -105,13 +162,36 @@ func (e Event) String() string {
 // of watcher's WinAPI function can be found at:
 //
 //	https://msdn.microsoft.com/en-us/library/windows/desktop/aa365465%28v=vs.85%29.aspx
+//
+// An EventInfo received from a channel is owned by the receiver. It is never
+// modified nor reused by the package, so it may be kept and passed around.
 type EventInfo interface {
 	Timestamp() int64 // timestamp of when event occured
 	Event() Event     // event value for the filesystem action
-	Path() string     // real path of the file or directory
+	Path() string     // real path of the file or directory, see WithAlias
+	IsDir() bool      // whether the file is a directory
+	Root() string     // path of the matching watchpoint
+	Rel() string      // path relative to Root
 	Sys() interface{} // underlying data source (can return nil)
 }
 
+// releaser is implemented by events, which the watcher reuses once they are
+// released. The tree releases events, which it did not pass on to any channel,
+// as then nothing else refers to them. Events received from a user channel are
+// owned by the receiver and are never released, modified nor reused.
+type releaser interface {
+	release()
+}
+
+// release gives ei back to the watcher, which sent it, if the watcher reuses
+// its events. Neither ei nor the values it gave may be used afterwards, apart
+// from its path.
+func release(ei EventInfo) {
+	if r, ok := ei.(releaser); ok {
+		r.release()
+	}
+}
+
 type isDirer interface {
 	isDir() (bool, error)
 }
@@ -124,11 +204,199 @@ func (e *event) String() string {
 	return e.Event().String() + `: "` + e.Path() + `"`
 }
 
+// matched is an EventInfo which was matched against a watchpoint. Events
+// reported by watchers are not matched yet, so their Root is empty.
+//
+// It also carries the optional data Notify gathers for an event. As methods
+// of wrapped values are not promoted, the data is exposed by wrapping matched
+// with one of the types returned by export.
+type matched struct {
+	EventInfo
+	root  string
+	st    *snapshot
+	ch    *change
+	alias *aliased
+}
+
+// aliased holds the paths of an event rewritten with the user's spelling.
+type aliased struct {
+	path string
+	root string
+}
+
+var _ fmt.Stringer = (*matched)(nil)
+
+func newMatched(ei EventInfo, root string) *matched {
+	if m, ok := ei.(*matched); ok {
+		return &matched{EventInfo: m.EventInfo, root: root, st: m.st, ch: m.ch}
+	}
+	return &matched{EventInfo: ei, root: root}
+}
+
+func (m *matched) Event() Event {
+	if m.ch != nil {
+		return m.ch.event
+	}
+	return m.EventInfo.Event()
+}
+
+func (m *matched) Path() string {
+	if m.alias != nil {
+		return m.alias.path
+	}
+	return m.EventInfo.Path()
+}
+
+func (m *matched) Root() string {
+	if m.alias != nil {
+		return m.alias.root
+	}
+	return m.root
+}
+
+func (m *matched) Rel() string {
+	if m.alias != nil {
+		return rel(m.alias.root, m.alias.path)
+	}
+	return rel(m.root, m.EventInfo.Path())
+}
+
+// Replayed implements Replayer interface.
+func (m *matched) Replayed() bool {
+	s, ok := m.EventInfo.(*synthetic)
+	return ok && s.replayed
+}
+
+// Err implements Errorer interface.
+func (m *matched) Err() error {
+	if s, ok := m.EventInfo.(*synthetic); ok {
+		return s.err
+	}
+	return nil
+}
+
+// String implements fmt.Stringer interface.
+func (m *matched) String() string {
+	return m.Event().String() + `: "` + m.Path() + `"`
+}
+
+// export gives the value which is sent to user channels, implementing the
+// Stater and Changer interfaces only when m carries the respective data.
+func (m *matched) export() EventInfo {
+	switch {
+	case m.st != nil && m.ch != nil:
+		return statChangeEvent{m}
+	case m.st != nil:
+		return statEvent{m}
+	case m.ch != nil:
+		return changeEvent{m}
+	default:
+		return m
+	}
+}
+
+// unexport gives the matched value of an event sent to a user channel.
+func unexport(ei EventInfo) (*matched, bool) {
+	switch e := ei.(type) {
+	case *matched:
+		return e, true
+	case statEvent:
+		return e.matched, true
+	case changeEvent:
+		return e.matched, true
+	case statChangeEvent:
+		return e.matched, true
+	default:
+		return nil, false
+	}
+}
+
+// Replayer is implemented by all events sent to user channels.
+type Replayer interface {
+	// Replayed reports whether the event describes an entry, which already
+	// existed when the watch was set, as found by the initial scan of the
+	// WithInitialScan option.
+	Replayed() bool
+}
+
+// Errorer is implemented by all events sent to user channels.
+type Errorer interface {
+	// Err gives the error, which caused the WatchFailed event, and nil for
+	// any other event.
+	Err() error
+}
+
+// Stater is implemented by events sent to channels watched with the WithStat
+// option.
+type Stater interface {
+	// Stat gives the result of lstat(2) called on the path when the event
+	// was dispatched, not right after it was read, see WithStat. If the file
+	// had already disappeared, the error satisfies
+	// errors.Is(err, fs.ErrNotExist).
+	Stat() (os.FileInfo, error)
+}
+
+// snapshot is a result of lstat(2), shared by all the copies of an event.
+type snapshot struct {
+	fi  os.FileInfo
+	err error
+}
+
+func newSnapshot(path string) *snapshot {
+	fi, err := os.Lstat(path)
+	return &snapshot{fi: fi, err: err}
+}
+
+// statEvent is an EventInfo with a stat snapshot attached.
+type statEvent struct{ *matched }
+
+var _ Stater = statEvent{}
+
+func (e statEvent) Stat() (os.FileInfo, error) { return e.st.fi, e.st.err }
+
+// synthetic is an event generated by Notify itself, rather than reported by
+// the underlying watcher.
+type synthetic struct {
+	path      string
+	event     Event
+	isdir     bool
+	replayed  bool  // see Replayer
+	err       error // see Errorer
+	timestamp int64
+}
+
+var _ fmt.Stringer = (*synthetic)(nil)
+
+func newSynthetic(path string, e Event, isdir bool) *synthetic {
+	return &synthetic{path: path, event: e, isdir: isdir, timestamp: time.Now().Unix()}
+}
+
+func (e *synthetic) Timestamp() int64     { return e.timestamp }
+func (e *synthetic) Event() Event         { return e.event }
+func (e *synthetic) Path() string         { return e.path }
+func (e *synthetic) IsDir() bool          { return e.isdir }
+func (e *synthetic) Root() string         { return "" }
+func (e *synthetic) Rel() string          { return e.path }
+func (e *synthetic) Sys() interface{}     { return nil }
+func (e *synthetic) isDir() (bool, error) { return e.isdir, nil }
+
+// String implements fmt.Stringer interface.
+func (e *synthetic) String() string {
+	return e.Event().String() + `: "` + e.Path() + `"`
+}
+
 var estr = map[Event]string{
-	Create: "notify.Create",
-	Remove: "notify.Remove",
-	Write:  "notify.Write",
-	Rename: "notify.Rename",
+	Create:       "notify.Create",
+	Remove:       "notify.Remove",
+	Write:        "notify.Write",
+	Rename:       "notify.Rename",
+	Chmod:        "notify.Chmod",
+	Chown:        "notify.Chown",
+	Touch:        "notify.Touch",
+	Xattr:        "notify.Xattr",
+	WatchRemoved: "notify.WatchRemoved",
+	Synced:       "notify.Synced",
+	WatchFailed:  "notify.WatchFailed",
 	// Display name for recursive event is added only for debugging
 	// purposes. It's an internal event after all and won't be exposed to the
 	// user. Having Recursive event printable is helpful, e.g. for reading
@@ -20,6 +20,32 @@ const (
 	omit
 )
 
+// Platform independent attribute change event values.
+const (
+	osSpecificChmod Event = 0x00010000 << iota
+	osSpecificChown
+	osSpecificTouch
+	osSpecificXattr
+)
+
+// Platform independent watch lifecycle event values. None of them is ever
+// reported by the watcher.
+const (
+	osSpecificWatchRemoved Event = 0x00004000
+	osSpecificSynced       Event = 0x00008000
+	osSpecificWatchFailed  Event = 0x00200000
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved
+)
+
+// Watcher behavior flags set with options are not supported.
+const (
+	onlyDir    Event = 0
+	dontFollow Event = 0
+	exclUnlink Event = 0
+)
+
 const (
 	// FileAccess is an event reported when monitored file/directory was accessed.
 	FileAccess = fileAccess
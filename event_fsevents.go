@@ -20,6 +20,33 @@ const (
 	omit = Event(0x400000)
 )
 
+// Platform independent attribute change event values. Unlike the above, they
+// do not correspond to any FSEvents flag.
+const (
+	osSpecificChmod Event = 0x800000 << iota
+	osSpecificChown
+	osSpecificTouch
+	osSpecificXattr
+)
+
+// Platform independent watch lifecycle event values. None of them is ever
+// reported by the watcher.
+const (
+	osSpecificWatchRemoved Event = 0x8000000
+	osSpecificSynced       Event = 0x10000000
+	osSpecificWatchFailed  Event = 0x20000000
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved
+)
+
+// Watcher behavior flags set with options are not supported.
+const (
+	onlyDir    Event = 0
+	dontFollow Event = 0
+	exclUnlink Event = 0
+)
+
 // FSEvents specific event values.
 const (
 	FSEventsMustScanSubDirs Event = 0x00001
@@ -97,3 +124,6 @@ func (ei *event) Event() Event         { return ei.event }
 func (ei *event) Path() string         { return ei.fse.Path }
 func (ei *event) Sys() interface{}     { return &ei.fse }
 func (ei *event) isDir() (bool, error) { return ei.fse.Flags&FSEventsIsDir != 0, nil }
+func (ei *event) IsDir() bool          { return ei.fse.Flags&FSEventsIsDir != 0 }
+func (ei *event) Root() string         { return "" }
+func (ei *event) Rel() string          { return ei.fse.Path }
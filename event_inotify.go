@@ -7,7 +7,11 @@
 
 package notify
 
-import "golang.org/x/sys/unix"
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
 
 // Platform independent event values.
 const (
@@ -23,6 +27,32 @@ const (
 	omit
 )
 
+// Platform independent attribute change event values. The bits are chosen
+// not to overlap with any value inotify may report in an event mask.
+const (
+	osSpecificChmod Event = 0x10000 << iota
+	osSpecificChown
+	osSpecificTouch
+	osSpecificXattr
+)
+
+// Platform independent watch lifecycle event values. WatchRemoved reuses
+// the IN_IGNORED bit, as it is never passed to inotify_add_watch(2), and so
+// does WatchFailed with IN_Q_OVERFLOW. Synced takes a bit, which is not used
+// by inotify.
+const (
+	osSpecificWatchRemoved = Event(unix.IN_IGNORED)
+	osSpecificSynced       = Event(0x1000)
+	osSpecificWatchFailed  = Event(unix.IN_Q_OVERFLOW)
+
+	// Unmounted is sent instead of WatchRemoved when the watch was removed,
+	// because the filesystem containing the watched path was unmounted.
+	Unmounted = Event(unix.IN_UNMOUNT)
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved | Unmounted
+)
+
 // Inotify specific masks are legal, implemented events that are guaranteed to
 // work with notify package on linux-based systems.
 const (
@@ -53,6 +83,7 @@ var osestr = map[Event]string{
 	InMovedTo:      "notify.InMovedTo",
 	InMoveSelf:     "notify.InMoveSelf",
 	InOpen:         "notify.InOpen",
+	Unmounted:      "notify.Unmounted",
 }
 
 var osstre = map[string]Event{
@@ -68,15 +99,25 @@ var osstre = map[string]Event{
 	"notify.InMovedTo":      InMovedTo,
 	"notify.InMoveSelf":     InMoveSelf,
 	"notify.InOpen":         InOpen,
+	"notify.Unmounted":      Unmounted,
 }
 
-// Inotify behavior events are not **currently** supported by notify package.
+// Inotify behavior flags are not events and cannot be passed to Watch.
+// IN_ONESHOT is emulated by the tree (see WithOneshot), as a watch descriptor
+// may be shared by many watchpoints. IN_MASK_ADD is not needed, as the tree
+// always passes the joint event set of all watchpoints.
 const (
-	inDontFollow = Event(unix.IN_DONT_FOLLOW)
-	inExclUnlink = Event(unix.IN_EXCL_UNLINK)
-	inMaskAdd    = Event(unix.IN_MASK_ADD)
-	inOneshot    = Event(unix.IN_ONESHOT)
-	inOnlydir    = Event(unix.IN_ONLYDIR)
+	inMaskAdd = Event(unix.IN_MASK_ADD)
+	inOneshot = Event(unix.IN_ONESHOT)
+)
+
+// Watcher behavior flags set with options. IN_ONLYDIR and IN_DONT_FOLLOW
+// overlap with recursive and omit, so they are kept on unused bits, which are
+// translated by encode.
+const (
+	onlyDir    Event = 0x08000000
+	dontFollow Event = 0x10000000
+	exclUnlink       = Event(unix.IN_EXCL_UNLINK)
 )
 
 type event struct {
@@ -86,8 +127,26 @@ type event struct {
 	timestamp int64
 }
 
+// eventPool holds the events released by the tree, which are reused for the
+// events read next.
+var eventPool = sync.Pool{New: func() interface{} { return new(event) }}
+
+// newEvent gives an event taken from eventPool.
+func newEvent() *event {
+	return eventPool.Get().(*event)
+}
+
+// release implements releaser.
+func (e *event) release() {
+	*e = event{}
+	eventPool.Put(e)
+}
+
 func (e *event) Timestamp() int64     { return e.timestamp }
 func (e *event) Event() Event         { return e.event }
 func (e *event) Path() string         { return e.path }
 func (e *event) Sys() interface{}     { return &e.sys }
 func (e *event) isDir() (bool, error) { return e.sys.Mask&unix.IN_ISDIR != 0, nil }
+func (e *event) IsDir() bool          { return e.sys.Mask&unix.IN_ISDIR != 0 }
+func (e *event) Root() string         { return "" }
+func (e *event) Rel() string          { return e.path }
@@ -26,6 +26,32 @@ const (
 	omit
 )
 
+// Platform independent attribute change event values.
+const (
+	osSpecificChmod Event = 0x10000 << iota
+	osSpecificChown
+	osSpecificTouch
+	osSpecificXattr
+)
+
+// Platform independent watch lifecycle event values. None of them is ever
+// reported by the watcher.
+const (
+	osSpecificWatchRemoved Event = 0x4000
+	osSpecificSynced       Event = 0x8000
+	osSpecificWatchFailed  Event = 0x100000
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved
+)
+
+// Watcher behavior flags set with options are not supported.
+const (
+	onlyDir    Event = 0
+	dontFollow Event = 0
+	exclUnlink Event = 0
+)
+
 const (
 	// NoteDelete is an event reported when the unlink() system call was called
 	// on the file referenced by the descriptor.
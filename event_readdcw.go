@@ -28,6 +28,34 @@ const (
 	dirmarker
 )
 
+// Platform independent attribute change event values. They occupy the bits
+// of the notify changes part of the filter, which are not used by any of the
+// FileNotifyChange* values.
+const (
+	osSpecificChmod Event = 0x080
+	osSpecificChown Event = 0x200
+	osSpecificTouch Event = 0x400
+	osSpecificXattr Event = 0x800
+)
+
+// Platform independent watch lifecycle event values. None of them is ever
+// reported by the watcher.
+const (
+	osSpecificWatchRemoved Event = 1 << 27
+	osSpecificSynced       Event = 1 << 28
+	osSpecificWatchFailed  Event = 1 << 29
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved
+)
+
+// Watcher behavior flags set with options are not supported.
+const (
+	onlyDir    Event = 0
+	dontFollow Event = 0
+	exclUnlink Event = 0
+)
+
 // ReadDirectoryChangesW filters
 // On Windows the following events can be passed to Watch. A different set of
 // events (see actions below) are received on the channel passed to Watch.
@@ -107,6 +135,16 @@ func (e *event) Event() Event     { return e.e }
 func (e *event) Path() string     { return filepath.Join(syscall.UTF16ToString(e.pathw), e.name) }
 func (e *event) Sys() interface{} { return e.ftype }
 
+func (e *event) Root() string { return "" }
+func (e *event) Rel() string  { return e.Path() }
+
+// IsDir falls back to stat(2) when the type of the file was not reported by
+// ReadDirectoryChangesW, it reports false if the file no longer exists.
+func (e *event) IsDir() bool {
+	ok, err := e.isDir()
+	return ok && err == nil
+}
+
 func (e *event) isDir() (bool, error) {
 	if e.ftype != fTypeUnknown {
 		return e.ftype == fTypeDirectory, nil
@@ -21,6 +21,32 @@ const (
 	omit
 )
 
+// Platform independent attribute change event values.
+const (
+	osSpecificChmod Event = 0x40 << iota
+	osSpecificChown
+	osSpecificTouch
+	osSpecificXattr
+)
+
+// Platform independent watch lifecycle event values. None of them is ever
+// reported by the watcher.
+const (
+	osSpecificWatchRemoved Event = 0x400
+	osSpecificSynced       Event = 0x800
+	osSpecificWatchFailed  Event = 0x1000
+
+	// watchLost are the events reported when the watcher dropped a watch.
+	watchLost = WatchRemoved
+)
+
+// Watcher behavior flags set with options are not supported.
+const (
+	onlyDir    Event = 0
+	dontFollow Event = 0
+	exclUnlink Event = 0
+)
+
 var osestr = map[Event]string{}
 
 type event struct{}
@@ -29,3 +55,6 @@ func (e *event) Event() (_ Event)         { return }
 func (e *event) Path() (_ string)         { return }
 func (e *event) Sys() (_ interface{})     { return }
 func (e *event) isDir() (_ bool, _ error) { return }
+func (e *event) IsDir() (_ bool)          { return }
+func (e *event) Root() (_ string)         { return }
+func (e *event) Rel() (_ string)          { return }
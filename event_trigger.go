@@ -21,3 +21,9 @@ func (e *event) Path() string { return e.p }
 func (e *event) Sys() interface{} { return e.pe }
 
 func (e *event) isDir() (bool, error) { return e.d, nil }
+
+func (e *event) IsDir() bool { return e.d }
+
+func (e *event) Root() string { return "" }
+
+func (e *event) Rel() string { return e.p }
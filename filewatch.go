@@ -0,0 +1,132 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileSettle is the time a watched file must remain unchanged, before the
+// changes made to it are reported as a single event.
+const fileSettle = 50 * time.Millisecond
+
+var errNotFile = errors.New("notify: path is a directory")
+
+// fileWatch is a watchpoint on a single file, which is set on the parent
+// directory of the file, thus it survives replacing the file with another
+// one. Changes of the file are coalesced and reported as a single event after
+// the file settles.
+type fileWatch struct {
+	relay
+	p      *persistent    // watch on the parent directory
+	pc     chan EventInfo // proxy channel of p
+	base   string
+	events Event
+	path   string // canonical path of the file, as last reported
+	exists bool   // whether the file existed before the pending changes
+	dirty  bool   // whether the file was written or created
+	gone   Event  // Remove or Rename, if the file vanished
+	timer  *time.Timer
+}
+
+func newFileWatch(t tree, path string, c chan<- EventInfo, events Event) (*fileWatch, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, errNotFile
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	f := &fileWatch{
+		pc:     make(chan EventInfo, buffer),
+		relay:  relay{c: c},
+		base:   filepath.Base(path),
+		events: events,
+		path:   path,
+		exists: err == nil,
+		timer:  time.NewTimer(fileSettle),
+	}
+	f.timer.Stop()
+	e := Create | Remove | Write | Rename | events&Attrib
+	if f.p, err = newPersistent(t, filepath.Dir(path), f.pc, options{}, e); err != nil {
+		return nil, err
+	}
+	f.start(f.loop)
+	return f, nil
+}
+
+func (f *fileWatch) loop() {
+	for {
+		select {
+		case <-f.quit:
+			f.timer.Stop()
+			return
+		case ei := <-f.pc:
+			f.update(ei)
+		case <-f.timer.C:
+			f.flush()
+		}
+	}
+}
+
+// update records a change of the file. Metadata changes are sent right away.
+func (f *fileWatch) update(ei EventInfo) {
+	switch ei.Rel() {
+	case ".":
+		// The parent directory was created again, so may be the file.
+		if ei.Event() == Create {
+			path := filepath.Join(ei.Path(), f.base)
+			if _, err := os.Lstat(path); err == nil {
+				f.path, f.dirty, f.gone = path, true, 0
+				f.timer.Reset(fileSettle)
+			}
+		}
+		return
+	case f.base:
+	default:
+		return
+	}
+	f.path = ei.Path()
+	switch e := ei.Event(); {
+	case e&(Create|Write) != 0:
+		f.dirty, f.gone = true, 0
+		f.timer.Reset(fileSettle)
+	case e&(Remove|Rename) != 0:
+		f.gone = e
+		f.timer.Reset(fileSettle)
+	case e&f.events != 0:
+		f.send(ei)
+	}
+}
+
+// flush reports the changes made to the file since the last flush.
+func (f *fileWatch) flush() {
+	var e Event
+	switch {
+	case f.gone != 0:
+		e, f.exists = f.gone, false
+	case f.dirty && !f.exists && f.events&Create != 0:
+		e, f.exists = Create, true
+	case f.dirty:
+		e, f.exists = Write, true
+	}
+	f.dirty, f.gone = false, 0
+	if e != 0 && f.events&e != 0 {
+		f.send(newMatched(newSynthetic(f.path, e, false), f.path).export())
+	}
+}
+
+// Stop implements proxy interface.
+func (f *fileWatch) Stop() {
+	f.p.Stop()
+	f.stop()
+}
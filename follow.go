@@ -0,0 +1,315 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// follower is a recursive watchpoint, which descends into symlinked
+// directories. Targets of the symlinks, which lie outside of the watched
+// directories, are watched recursively on their own. Events are reported
+// under their real paths and, for each symlink leading to them, under the
+// path where the link appears.
+//
+// Directories are identified by their device and inode numbers, so each one
+// is watched once, no matter how many links lead to it, and cycles are not
+// followed.
+type follower struct {
+	relay
+	t       tree
+	root    string // canonical path of the Watch call, without "..."
+	o       options
+	events  Event
+	pc      chan EventInfo       // proxy channel of all the watches
+	seen    map[string]string    // real paths of the visited directories by their ids
+	links   map[string]string    // real paths of symlinked directories by link paths
+	targets map[string]*followed // watched targets outside of root
+}
+
+// followed is a symlink target outside of root, which is watched on its own
+// proxy channel, so it can be unwatched once no symlink leads to it.
+type followed struct {
+	c    chan EventInfo
+	done chan struct{} // closed when the target is unwatched
+}
+
+func newFollower(t tree, path string, c chan<- EventInfo, o options,
+	events Event) (*follower, error) {
+	root, _, err := cleanpath(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &follower{
+		t:       t,
+		root:    root,
+		relay:   relay{c: c},
+		o:       o,
+		events:  events,
+		pc:      make(chan EventInfo, buffer),
+		seen:    make(map[string]string),
+		links:   make(map[string]string),
+		targets: make(map[string]*followed),
+	}
+	f.o.follow = false
+	if err = f.watch(root, f.pc); err != nil {
+		return nil, err
+	}
+	// Targets are not scanned, as their events would follow Synced of root.
+	f.o.scan = false
+	f.scan(root)
+	f.start(f.loop)
+	return f, nil
+}
+
+// watch sets a recursive watch on dir. Create, Remove and Rename events are
+// always watched, in order to keep track of the symlinks.
+func (f *follower) watch(dir string, c chan EventInfo) error {
+	return f.t.Watch(filepath.Join(dir, "..."), c, f.o, f.events|Create|Remove|Rename)
+}
+
+// dirid identifies a directory by its device and inode numbers, or by its
+// canonical path if the former are not available.
+func dirid(path string, fi os.FileInfo) string {
+	if dev, ino, ok := fileid(fi); ok {
+		return strconv.FormatUint(dev, 10) + ":" + strconv.FormatUint(ino, 10)
+	}
+	return path
+}
+
+// scan looks for symlinked directories in the subtree of dir.
+func (f *follower) scan(dir string) {
+	fn := func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return nil
+		case p != dir && f.o.doNotWatch != nil && f.o.doNotWatch(p):
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			f.link(p)
+			return nil
+		case !d.IsDir():
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		id := dirid(p, fi)
+		if _, ok := f.seen[id]; ok {
+			return filepath.SkipDir
+		}
+		f.seen[id] = p
+		return nil
+	}
+	filepath.WalkDir(dir, fn)
+}
+
+// link follows the symlink, if it points to a directory. The target is watched
+// and scanned, unless it was already visited.
+func (f *follower) link(path string) {
+	target, err := canonical(path)
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(target)
+	if err != nil || !fi.IsDir() {
+		return
+	}
+	if real, ok := f.seen[dirid(target, fi)]; ok {
+		f.links[path] = real
+		return
+	}
+	if f.under(target) || f.contains(target) {
+		// The target is either watched, but was not scanned yet, or it holds
+		// watched directories, which would be reported twice if watched again.
+		f.links[path] = target
+		return
+	}
+	tg := &followed{c: make(chan EventInfo, buffer), done: make(chan struct{})}
+	if err := f.watch(target, tg.c); err != nil {
+		dbgprintf("follower(%q) error: %v", path, err)
+		return
+	}
+	f.links[path] = target
+	f.targets[target] = tg
+	f.start(func() { f.forward(tg) })
+	f.scan(target)
+}
+
+// forward passes the events of the target to the loop.
+func (f *follower) forward(tg *followed) {
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-tg.done:
+			return
+		case ei := <-tg.c:
+			select {
+			case f.pc <- ei:
+			case <-f.quit:
+				return
+			}
+		}
+	}
+}
+
+// under reports whether the path lies within root or any of the watched
+// targets, which are still linked.
+func (f *follower) under(path string) bool {
+	if path == f.root || indexrel(f.root, path) != -1 {
+		return true
+	}
+	for _, target := range f.links {
+		if _, ok := f.targets[target]; ok && (path == target || indexrel(target, path) != -1) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether root or any of the watched targets lies within
+// the path.
+func (f *follower) contains(path string) bool {
+	if indexrel(path, f.root) != -1 {
+		return true
+	}
+	for target := range f.targets {
+		if indexrel(path, target) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// unlink forgets the symlinks found at the path or below it, and stops
+// watching the targets, which cannot be reached from root anymore.
+func (f *follower) unlink(path string) {
+	for link := range f.links {
+		if link == path || indexrel(path, link) != -1 {
+			delete(f.links, link)
+		}
+	}
+	reached := make(map[string]bool)
+	for more := true; more; {
+		more = false
+		for link, real := range f.links {
+			if !f.reaches(link, reached) {
+				continue
+			}
+			for target := range f.targets {
+				if !reached[target] && (real == target || indexrel(target, real) != -1) {
+					reached[target], more = true, true
+				}
+			}
+		}
+	}
+	for target, tg := range f.targets {
+		if reached[target] {
+			continue
+		}
+		f.t.Stop(tg.c)
+		close(tg.done)
+		delete(f.targets, target)
+		// The target is scanned again, if it is linked again.
+		for id, dir := range f.seen {
+			if dir == target || indexrel(target, dir) != -1 {
+				delete(f.seen, id)
+			}
+		}
+		for link := range f.links {
+			if indexrel(target, link) != -1 {
+				delete(f.links, link)
+			}
+		}
+	}
+}
+
+// reaches reports whether the path lies within root or any of the reached
+// targets.
+func (f *follower) reaches(path string, reached map[string]bool) bool {
+	if indexrel(f.root, path) != -1 {
+		return true
+	}
+	for target := range reached {
+		if indexrel(target, path) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *follower) loop() {
+	for {
+		select {
+		case <-f.quit:
+			return
+		case ei := <-f.pc:
+			f.update(ei)
+		}
+	}
+}
+
+// update keeps track of the symlinks and sends the event under its real path
+// and the paths of the symlinks leading to it.
+func (f *follower) update(ei EventInfo) {
+	switch ei.Event() {
+	case Create:
+		if fi, err := os.Lstat(ei.Path()); err == nil {
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				f.link(ei.Path())
+			case fi.IsDir():
+				f.scan(ei.Path())
+			}
+		}
+	case Remove, Rename:
+		f.unlink(ei.Path())
+	}
+	if ei.Event()&(f.events|watchLost|Synced) == 0 || !f.under(ei.Path()) {
+		return
+	}
+	f.send(ei)
+	m, ok := unexport(ei)
+	if !ok {
+		return
+	}
+	for _, path := range f.aliases(ei.Path(), make(map[string]bool), nil) {
+		a := *m
+		a.alias = &aliased{path: path, root: f.root}
+		f.send(a.export())
+	}
+}
+
+// aliases gives the paths the path can be reached through by following the
+// symlinks. Each symlink is followed at most once, so cycles are reported once.
+func (f *follower) aliases(path string, used map[string]bool, paths []string) []string {
+	for link, target := range f.links {
+		if used[link] || (path != target && indexrel(target, path) == -1) {
+			continue
+		}
+		alias := link + path[len(target):]
+		used[link] = true
+		paths = f.aliases(alias, used, append(paths, alias))
+		delete(used, link)
+	}
+	return paths
+}
+
+// Stop implements proxy interface.
+func (f *follower) Stop() {
+	f.stop()
+	f.t.Stop(f.pc)
+	for _, tg := range f.targets {
+		f.t.Stop(tg.c)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build darwin || linux || freebsd || dragonfly || netbsd || openbsd || solaris
+// +build darwin linux freebsd dragonfly netbsd openbsd solaris
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collect gathers paths of events received on c until no event arrives for
+// a while.
+func collect(t *testing.T, c <-chan EventInfo, e Event) []string {
+	t.Helper()
+	var paths []string
+	for {
+		select {
+		case ev := <-c:
+			if ev.Event() == e {
+				paths = append(paths, ev.Path())
+			}
+		case <-time.After(200 * time.Millisecond):
+			sort.Strings(paths)
+			return paths
+		}
+	}
+}
+
+func TestWatchFollowSymlinks(t *testing.T) {
+	n, tmpDir := newProxyTest(t)
+	var (
+		root  = filepath.Join(tmpDir, "repo")
+		store = filepath.Join(tmpDir, "store", "pkg")
+		link  = filepath.Join(root, "node_modules", "pkg")
+		link2 = filepath.Join(root, "node_modules", "alias")
+		loop  = filepath.Join(root, "loop")
+	)
+	mustT(t, os.MkdirAll(store, 0755))
+	mustT(t, os.MkdirAll(filepath.Dir(link), 0755))
+	mustT(t, os.Symlink(store, link))
+	mustT(t, os.Symlink(store, link2))
+	mustT(t, os.Symlink(root, loop))
+
+	c := watchProxy(t, n, filepath.Join(root, "..."), []Option{WithFollowSymlinks()}, Create)
+
+	mustT(t, os.WriteFile(filepath.Join(store, "index.js"), nil, 0644))
+	want := []string{
+		filepath.Join(loop, "node_modules", "alias", "index.js"),
+		filepath.Join(loop, "node_modules", "pkg", "index.js"),
+		filepath.Join(link2, "index.js"),
+		filepath.Join(link, "index.js"),
+		filepath.Join(store, "index.js"),
+	}
+	if got := collect(t, c, Create); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+
+	mustT(t, os.WriteFile(filepath.Join(root, "main.go"), nil, 0644))
+	want = []string{
+		filepath.Join(loop, "main.go"),
+		filepath.Join(root, "main.go"),
+	}
+	if got := collect(t, c, Create); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+
+	// Symlinks created after the Watch call are followed as well.
+	other := filepath.Join(tmpDir, "store", "other")
+	mustT(t, os.Mkdir(other, 0755))
+	link3 := filepath.Join(root, "node_modules", "other")
+	mustT(t, os.Symlink(other, link3))
+	collect(t, c, Create)
+	mustT(t, os.WriteFile(filepath.Join(other, "lib.js"), nil, 0644))
+	want = []string{
+		filepath.Join(loop, "node_modules", "other", "lib.js"),
+		filepath.Join(link3, "lib.js"),
+		filepath.Join(other, "lib.js"),
+	}
+	if got := collect(t, c, Create); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+
+	// Events of targets, which are no longer linked, are not reported.
+	mustT(t, os.Remove(link3))
+	collect(t, c, Create)
+	mustT(t, os.WriteFile(filepath.Join(other, "lib2.js"), nil, 0644))
+	if got := collect(t, c, Create); len(got) != 0 {
+		t.Fatalf("want no events; got %v", got)
+	}
+}
+
+func TestFollowerAliases(t *testing.T) {
+	f := &follower{links: map[string]string{
+		"/repo/a":    "/store/a",
+		"/store/a/b": "/store/b",
+		"/repo/loop": "/repo",
+	}}
+	got := f.aliases("/store/b/file", make(map[string]bool), nil)
+	sort.Strings(got)
+	want := []string{"/repo/a/b/file", "/repo/loop/a/b/file", "/store/a/b/file"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+}
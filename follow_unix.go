@@ -0,0 +1,23 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileid gives the device and inode numbers of a file, ok is false if fi does
+// not carry such information.
+func fileid(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
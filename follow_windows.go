@@ -0,0 +1,16 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package notify
+
+import "os"
+
+// fileid is not supported on Windows, file indexes are not a part of
+// os.FileInfo there.
+func fileid(os.FileInfo) (dev, ino uint64, ok bool) {
+	return
+}
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var errSkip = errors.New("notify: skip")
@@ -16,6 +18,36 @@ type walkPathFunc func(nd node, isbase bool) error
 
 type walkFunc func(node) error
 
+// skipFunc is called for every directory, which AddDir failed to add.
+type skipFunc func(name string, err error)
+
+// AddDirError is returned by recursive Watch calls made with the WithBestEffort
+// option, when some of the directories could not be watched. The watchpoint
+// is set nevertheless.
+type AddDirError struct {
+	// Skipped lists the directories, which are not watched, together with
+	// the reasons.
+	Skipped []*os.PathError
+}
+
+// Error implements error interface.
+func (e *AddDirError) Error() string {
+	s := "notify: skipped " + strconv.Itoa(len(e.Skipped)) + " directories"
+	if len(e.Skipped) != 0 {
+		s += ", first: " + e.Skipped[0].Error()
+	}
+	return s
+}
+
+// Unwrap gives the errors of the skipped directories.
+func (e *AddDirError) Unwrap() []error {
+	errs := make([]error, len(e.Skipped))
+	for i, err := range e.Skipped {
+		errs[i] = err
+	}
+	return errs
+}
+
 func errnotexist(name string) error {
 	return &os.PathError{
 		Op:   "Node",
@@ -24,24 +56,65 @@ func errnotexist(name string) error {
 	}
 }
 
+// node is a directory of the tree. Copies of a node share its entry, thus
+// changes made through any of them are seen by all.
 type node struct {
-	Name  string
-	Watch watchpoint
-	Child map[string]node
+	*entry
+}
+
+// entry holds a directory of the tree. The maps are allocated as they are
+// first written to, so directories without children or watchpoints take no
+// space for them. Directories, which carry the same internal watchpoint only,
+// share its map, see node.watch.
+type entry struct {
+	Name   string
+	Watch  watchpoint      // read-only if shared
+	Child  map[string]node // keyed by base names, sharing storage with their Name
+	shared bool            // whether Watch is shared with other nodes
 }
 
 func newnode(name string) node {
-	return node{
-		Name:  name,
-		Watch: make(watchpoint),
-		Child: make(map[string]node),
+	return node{&entry{Name: name}}
+}
+
+// watch gives the watchpoint of nd for writing. A missing watchpoint is
+// allocated and a shared one is copied first.
+func (nd node) watch() watchpoint {
+	if nd.Watch == nil || nd.shared {
+		wp := make(watchpoint, len(nd.Watch))
+		for c, e := range nd.Watch {
+			wp[c] = e
+		}
+		nd.Watch, nd.shared = wp, false
+	}
+	return nd.Watch
+}
+
+// share makes nd, which has no watchpoints yet, use the shared watchpoint wp.
+// It gives the diff as if the watchpoint was added with Add.
+func (nd node) share(wp watchpoint) eventDiff {
+	nd.Watch, nd.shared = wp, true
+	if e := wp.Total(); e != 0 {
+		return eventDiff{0, e}
 	}
+	return none
+}
+
+// unshare removes the shared watchpoint set with share.
+func (nd node) unshare() {
+	nd.Watch, nd.shared = nil, false
 }
 
 func (nd node) addchild(name, base string) node {
 	child, ok := nd.Child[base]
 	if !ok {
+		if strings.HasSuffix(name, base) {
+			base = name[len(name)-len(base):]
+		}
 		child = newnode(name)
+		if nd.Child == nil {
+			nd.Child = make(map[string]node)
+		}
 		nd.Child[base] = child
 	}
 	return child
@@ -59,45 +132,57 @@ func (nd node) Add(name string) node {
 	return nd.addchild(name, name[i:])
 }
 
-func (nd node) AddDir(fn walkFunc, doNotWatch DoNotWatchFn) error {
+// AddDir adds the subtree of nd to the tree and calls fn for every directory
+// in it. The depth limits the number of directory levels added below nd,
+// negative depth means no limit.
+//
+// If skip is nil, AddDir stops at the first error. Otherwise the directories,
+// which cannot be read or for which fn fails, are passed to skip and their
+// subtrees are left out. Failure of fn for nd itself is always returned.
+func (nd node) AddDir(fn walkFunc, doNotWatch DoNotWatchFn, depth int, skip skipFunc) error {
+	top := nd.Name
 	stack := []node{nd}
+	depths := []int{depth}
 Traverse:
 	for n := len(stack); n != 0; n = len(stack) {
 		nd, stack = stack[n-1], stack[:n-1]
+		depth, depths = depths[n-1], depths[:n-1]
 		switch err := fn(nd); err {
 		case nil:
 		case errSkip:
 			continue Traverse
 		default:
+			if skip != nil && nd.Name != top {
+				skip(nd.Name, err)
+				continue Traverse
+			}
 			return &os.PathError{
 				Op:   "error while traversing",
 				Path: nd.Name,
 				Err:  err,
 			}
 		}
-		// TODO(rjeczalik): tolerate open failures - add failed names to
-		// AddDirError and notify users which names are not added to the tree.
-		f, err := os.Open(nd.Name)
-		if err != nil {
-			return err
+		if depth == 0 {
+			continue Traverse
 		}
-		names, err := f.Readdirnames(-1)
-		f.Close()
+		entries, err := readdir(nd.Name)
 		if err != nil {
+			if skip != nil {
+				skip(nd.Name, err)
+				continue Traverse
+			}
 			return err
 		}
-		for _, name := range names {
-			name = filepath.Join(nd.Name, name)
-			if doNotWatch != nil && doNotWatch(name) {
+		for _, e := range entries {
+			if !e.IsDir() {
 				continue
 			}
-			fi, err := os.Lstat(name)
-			if err != nil {
-				return err
-			}
-			if fi.Mode()&(os.ModeSymlink|os.ModeDir) == os.ModeDir {
-				stack = append(stack, nd.addchild(name, name[len(nd.Name)+1:]))
+			name := filepath.Join(nd.Name, e.Name())
+			if doNotWatch != nil && doNotWatch(name) {
+				continue
 			}
+			stack = append(stack, nd.addchild(name, e.Name()))
+			depths = append(depths, max(depth-1, -1))
 		}
 	}
 	return nil
@@ -141,11 +226,8 @@ func (nd node) Del(name string) error {
 	delete(nd.Child, name[i:])
 	for name, i = name[i:], len(stack); i != 0; name, i = base(nd.Name), i-1 {
 		nd = stack[i-1]
-		if nd := nd.Child[name]; len(nd.Watch) > 1 || len(nd.Child) != 0 {
+		if child, ok := nd.Child[name]; ok && (len(child.Watch) > 1 || len(child.Child) != 0) {
 			break
-		} else {
-			nd.Child = nil
-			nd.Watch = nil
 		}
 		delete(nd.Child, name)
 	}
@@ -247,8 +329,9 @@ func (r root) Add(name string) node {
 	return r.addroot(name).Add(name)
 }
 
-func (r root) AddDir(dir string, fn walkFunc, doNotWatch DoNotWatchFn) error {
-	return r.Add(dir).AddDir(fn, doNotWatch)
+func (r root) AddDir(dir string, fn walkFunc, doNotWatch DoNotWatchFn, depth int,
+	skip skipFunc) error {
+	return r.Add(dir).AddDir(fn, doNotWatch, depth, skip)
 }
 
 func (r root) Del(name string) error {
@@ -0,0 +1,57 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeAddDirSkip(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/b/c", "a/d", "e"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errDenied := errors.New("denied")
+	fn := func(nd node) error {
+		if nd.Name == filepath.Join(dir, "a", "b") {
+			return errDenied
+		}
+		return nil
+	}
+	r := root{nd: newnode("")}
+	if err := r.AddDir(dir, fn, nil, -1, nil); err == nil {
+		t.Fatal("want err!=nil")
+	}
+	r = root{nd: newnode("")}
+	skipped := make(map[string]error)
+	skip := func(name string, err error) { skipped[name] = err }
+	if err := r.AddDir(dir, fn, nil, -1, skip); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[filepath.Join(dir, "a", "b")] != errDenied {
+		t.Fatalf("want %s skipped; got %v", filepath.Join(dir, "a", "b"), skipped)
+	}
+	for _, p := range []string{"a/d", "e"} {
+		if _, err := r.Get(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := r.Get(filepath.Join(dir, "a", "b", "c")); err == nil {
+		t.Errorf("want %s not added", filepath.Join(dir, "a", "b", "c"))
+	}
+	// Failure for the directory itself is not skipped.
+	fn = func(node) error { return errDenied }
+	if err := r.AddDir(dir, fn, nil, -1, skip); err == nil {
+		t.Fatal("want err!=nil")
+	}
+}
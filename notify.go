@@ -2,14 +2,12 @@
 // Use of this source code is governed by the MIT license that can be
 // found in the LICENSE file.
 
-// BUG(rjeczalik): Notify does not collect watchpoints, when underlying watches
-// were removed by their os-specific watcher implementations. Instead users are
-// advised to listen on persistent paths to have guarantee they receive events
-// for the whole lifetime of their applications (to discuss see #69).
-
-// BUG(ppknap): Linux (inotify) does not support watcher behavior masks like
-// InOneshot, InOnlydir etc. Instead users are advised to perform the filtering
-// themselves (to discuss see #71).
+// BUG(rjeczalik): Notify collects watchpoints, when underlying watches were
+// removed by their os-specific watcher implementations, only under Linux
+// (inotify), see WatchRemoved. Elsewhere users are advised to listen on
+// persistent paths, or to use the WithPersistent option, to have guarantee
+// they receive events for the whole lifetime of their applications (to discuss
+// see #69).
 
 // BUG(ppknap): Notify  was not tested for short path name support under Windows
 // (ReadDirectoryChangesW).
@@ -19,12 +17,16 @@
 
 package notify
 
+import "context"
+
 type Notify struct {
-	tree tree
+	tree    tree
+	proxies *proxies
 }
 
-func NewNotify() Notify {
-	return Notify{tree: NewTree()}
+// NewNotify creates a Notify instance with the given options applied.
+func NewNotify(opts ...NotifyOption) Notify {
+	return Notify{tree: newTree(newConfig(opts)), proxies: newProxies()}
 }
 
 type DoNotWatchFn func(string) bool
@@ -52,7 +54,8 @@ func (notify *Notify) Exclude(pattern string) error {
 //
 // The c almost always is a buffered channel. Watch will not block sending to c
 // - the caller must ensure that c has sufficient buffer space to keep up with
-// the expected event rate.
+// the expected event rate. Events are sent to c in the order they were
+// reported by the underlying watcher.
 //
 // It is allowed to pass the same channel multiple times with different event
 // list or different paths. Calling Watch with different event lists for a single
@@ -80,7 +83,7 @@ func (notify *Notify) Exclude(pattern string) error {
 // e.g. use persistent paths like %userprofile% or watch additionally parent
 // directory of a recursive watchpoint in order to receive delete events for it.
 func (notify *Notify) Watch(path string, c chan<- EventInfo, events ...Event) error {
-	return notify.tree.Watch(path, c, nil, events...)
+	return notify.tree.Watch(path, c, options{}, events...)
 }
 
 // This function works the same way as Watch. In addition it does not watch
@@ -89,7 +92,106 @@ func (notify *Notify) Watch(path string, c chan<- EventInfo, events ...Event) er
 // file or directory should not be watched.
 func (notify *Notify) WatchWithFilter(path string, c chan<- EventInfo,
 	doNotWatch func(string) bool, events ...Event) error {
-	return notify.tree.Watch(path, c, doNotWatch, events...)
+	return notify.tree.Watch(path, c, options{doNotWatch: doNotWatch}, events...)
+}
+
+// WatchWith works the same way as Watch, but with the given options applied.
+// Options which alter events, like WithStat, apply to every event sent to c,
+// regardless of which Watch call set it up.
+// Watcher behavior options, like WithExclUnlink, apply to the underlying
+// watches, which may be shared with other watchpoints set on the same paths.
+//
+// Calling WatchWith with empty event list does not expand nor shrink
+// watchpoint's event set.
+//
+// WithFollowSymlinks, WithTrackSymlinks and WithPersistent are mutually
+// exclusive, WatchWith returns an error if more than one of them is given,
+// or if WithFollowSymlinks is given for a non-recursive path.
+func (notify *Notify) WatchWith(path string, c chan<- EventInfo, opts []Option,
+	events ...Event) error {
+	o := newOptions(opts)
+	if err := o.check(path); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return notify.tree.Watch(path, c, o)
+	}
+	e := joinevents(events)
+	switch {
+	case o.follow:
+		f, err := newFollower(notify.tree, path, c, o, e)
+		if err != nil {
+			return err
+		}
+		notify.proxies.Add(c, f)
+		return nil
+	case o.track:
+		tr, err := newTracker(notify.tree, path, c, o, e)
+		if err != nil {
+			return err
+		}
+		notify.proxies.Add(c, tr)
+		return nil
+	case o.persistent:
+		p, err := newPersistent(notify.tree, path, c, o, e)
+		if err != nil {
+			return err
+		}
+		notify.proxies.Add(c, p)
+		return nil
+	}
+	return notify.tree.Watch(path, c, o, events...)
+}
+
+// WatchAsync works the same way as WatchWith, but sets up the watchpoint in
+// the background and returns at once. The returned Setup tells when it is
+// finished and how far it got. While a recursive watchpoint is set up, the
+// tree lock is released every now and then, so events of other watchpoints
+// are dispatched in the meantime.
+//
+// Stopping c cancels the setup, which is then finished with context.Canceled.
+// Directories, which vanish during the setup, are left out.
+func (notify *Notify) WatchAsync(path string, c chan<- EventInfo, opts []Option,
+	events ...Event) *Setup {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Setup{ready: make(chan struct{}), cancel: cancel}
+	s.pr.ctx = ctx
+	p := &pending{Setup: s, stop: func() { notify.proxies.Stop(c) }}
+	notify.proxies.Add(c, p)
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.progress = &s.pr })
+	go func() {
+		s.err = notify.WatchWith(path, c, opts, events...)
+		notify.proxies.Del(c, p)
+		cancel()
+		close(s.ready)
+	}()
+	return s
+}
+
+// WatchFile sets up a watchpoint on a single file, listening for events given
+// by the events argument.
+//
+// Unlike Watch, the file does not need to exist. The watch is set on its parent
+// directory, so it survives saves done by editors, which write a new file and
+// rename it over the old one, as well as deleting and recreating the file.
+// Changes of the file are coalesced until it settles, thus each save is
+// reported as a single Write event, or Create if the file did not exist before.
+// Remove and Rename are reported when the file vanishes. Metadata change events
+// are sent as they come.
+//
+// Calling WatchFile with empty event list is a no-op. WatchFile fails if the
+// path points to an existing directory.
+func (notify *Notify) WatchFile(path string, c chan<- EventInfo, events ...Event) error {
+	e := joinevents(events)
+	if len(events) == 0 || e == 0 {
+		return nil
+	}
+	f, err := newFileWatch(notify.tree, path, c, e)
+	if err != nil {
+		return err
+	}
+	notify.proxies.Add(c, f)
+	return nil
 }
 
 // Stop removes all watchpoints registered for c. All underlying watches are
@@ -98,10 +200,22 @@ func (notify *Notify) WatchWithFilter(path string, c chan<- EventInfo,
 // Stop does not close c. When Stop returns, it is guaranteed that c will
 // receive no more signals.
 func (notify *Notify) Stop(c chan<- EventInfo) {
+	notify.proxies.Stop(c)
 	notify.tree.Stop(c)
 }
 
+// Stats gives the state of the watches. Under Linux (inotify) and other
+// platforms without native recursive watches, directories, which failed to
+// be watched within recursive watchpoints, are retried with exponential
+// backoff and listed in Stats until they are watched, removed or no longer
+// watched by any recursive watchpoint. Under Linux, Stats also describes the
+// queue of events read from inotify.
+func (notify *Notify) Stats() Stats {
+	return notify.tree.Stats()
+}
+
 // Close handles the cleanup of the tree related goroutines.
 func (notify *Notify) Close() {
+	notify.proxies.Stop(nil)
 	notify.tree.Close()
 }
@@ -7,7 +7,14 @@
 
 package notify
 
-import "testing"
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestNotifySystemAndGlobalMix(t *testing.T) {
 	n := NewNotifyTest(t, "testdata/vfs.txt")
@@ -32,5 +39,335 @@ func TestUnknownEvent(t *testing.T) {
 
 	ch := NewChans(1)
 
-	n.WatchErr("src/github.com/rjeczalik/fs", ch[0], nil, inExclUnlink)
+	n.WatchErr("src/github.com/rjeczalik/fs", ch[0], nil, inOneshot)
+}
+
+func TestWatchOnlyDir(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	mustT(t, os.WriteFile(file, []byte("abc"), 0644))
+
+	c := make(chan EventInfo, 1)
+	if err := n.WatchWith(file, c, []Option{WithOnlyDir()}, Write); err == nil {
+		t.Fatal("want err!=nil")
+	}
+	mustT(t, n.WatchWith(tmpDir+"/...", c, []Option{WithOnlyDir()}, Write))
+	n.Stop(c)
+}
+
+func TestWatchDontFollow(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file, link := filepath.Join(tmpDir, "file"), filepath.Join(tmpDir, "link")
+	mustT(t, os.WriteFile(file, []byte("abc"), 0644))
+	mustT(t, os.Symlink(file, link))
+
+	follow := make(chan EventInfo, 10)
+	nofollow := make(chan EventInfo, 10)
+	mustT(t, n.Watch(link, follow, Chmod))
+	defer n.Stop(follow)
+	n2 := NewNotify()
+	defer n2.Close()
+	mustT(t, n2.WatchWith(link, nofollow, []Option{WithDontFollow()}, Chmod))
+	defer n2.Stop(nofollow)
+
+	mustT(t, os.Chmod(file, 0600))
+	waitEvent(t, follow, Chmod)
+	select {
+	case ev := <-nofollow:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchAlias(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	real, current := filepath.Join(tmpDir, "releases", "42"), filepath.Join(tmpDir, "current")
+	mustT(t, os.MkdirAll(real, 0755))
+	mustT(t, os.Symlink(real, current))
+
+	alias := make(chan EventInfo, 10)
+	resolved := make(chan EventInfo, 10)
+	mustT(t, n.WatchWith(filepath.Join(current, "..."), alias, []Option{WithAlias()}, Create))
+	defer n.Stop(alias)
+	mustT(t, n.Watch(filepath.Join(current, "..."), resolved, Create))
+	defer n.Stop(resolved)
+
+	mustT(t, os.WriteFile(filepath.Join(real, "main.go"), nil, 0644))
+	if ev, want := waitEvent(t, alias, Create), filepath.Join(current, "main.go"); ev.Path() != want ||
+		ev.Root() != current || ev.Rel() != "main.go" {
+		t.Fatalf("want Create on %s with root %s; got %v (root=%s, rel=%s)", want, current, ev,
+			ev.Root(), ev.Rel())
+	}
+	if ev, want := waitEvent(t, resolved, Create), filepath.Join(real, "main.go"); ev.Path() != want {
+		t.Fatalf("want Create on %s; got %v", want, ev)
+	}
+}
+
+func TestWatchAliasMixed(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	real, link := filepath.Join(tmpDir, "real"), filepath.Join(tmpDir, "link")
+	mustT(t, os.MkdirAll(filepath.Join(real, "sub"), 0755))
+	mustT(t, os.Symlink(filepath.Join(real, "sub"), link))
+
+	// The plain watchpoint's root is not covered by the alias.
+	c := make(chan EventInfo, 10)
+	mustT(t, n.Watch(filepath.Join(real, "..."), c, Create))
+	mustT(t, n.WatchWith(link, c, []Option{WithAlias()}, Create))
+	defer n.Stop(c)
+
+	mustT(t, os.WriteFile(filepath.Join(real, "sub", "f"), nil, 0644))
+	got := 0
+	for timeout := time.After(200 * time.Millisecond); ; {
+		select {
+		case ev := <-c:
+			got++
+			if rel := ev.Rel(); filepath.IsAbs(rel) || filepath.Join(ev.Root(), rel) != ev.Path() {
+				t.Fatalf("want Rel relative to Root; got %v (root=%s, rel=%s)", ev, ev.Root(), rel)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	if got == 0 {
+		t.Fatal("want Create on f")
+	}
+}
+
+func TestWatchMaxDepthWatches(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	mustT(t, os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755))
+
+	c := make(chan EventInfo, 10)
+	mustT(t, n.WatchWith(filepath.Join(root, "..."), c, []Option{WithMaxDepth(1)}, Create))
+	defer n.Stop(c)
+	i := n.tree.(*internalTree).w.(*inotify)
+	if nd, err := n.tree.(*internalTree).root.Get(filepath.Join(root, "a", "b")); err == nil {
+		t.Fatalf("want %s not added to the tree; got %v", nd.Name, nd.Watch)
+	}
+	i.RLock()
+	watches := len(i.m)
+	i.RUnlock()
+	if watches != 2 {
+		t.Fatalf("want 2 inotify watches; got %d", watches)
+	}
+	// Extending the limit adds the deeper directories.
+	mustT(t, n.WatchWith(filepath.Join(root, "..."), c, []Option{WithMaxDepth(2)}, Create))
+	if _, err := n.tree.(*internalTree).root.Get(filepath.Join(root, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.tree.(*internalTree).root.Get(filepath.Join(root, "a", "b", "c")); err == nil {
+		t.Fatalf("want %s not added to the tree", filepath.Join(root, "a", "b", "c"))
+	}
+}
+
+func TestWatchBestEffort(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	n := NewNotify()
+	defer n.Close()
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	denied := filepath.Join(root, "denied")
+	mustT(t, os.MkdirAll(filepath.Join(denied, "sub"), 0755))
+	mustT(t, os.Mkdir(filepath.Join(root, "ok"), 0755))
+	mustT(t, os.Chmod(denied, 0))
+	defer os.Chmod(denied, 0755)
+
+	c := make(chan EventInfo, 10)
+	n2 := NewNotify()
+	defer n2.Close()
+	if err := n2.Watch(filepath.Join(root, "..."), c, Create); err == nil {
+		t.Fatal("want err!=nil")
+	}
+	err = n.WatchWith(filepath.Join(root, "..."), c, []Option{WithBestEffort()}, Create)
+	var ade *AddDirError
+	if !errors.As(err, &ade) || len(ade.Skipped) != 1 || ade.Skipped[0].Path != denied {
+		t.Fatalf("want AddDirError for %s; got %v", denied, err)
+	}
+	defer n.Stop(c)
+	mustT(t, os.WriteFile(filepath.Join(root, "ok", "file"), nil, 0644))
+	waitEvent(t, c, Create)
+	// The skipped directory is added once it can be read.
+	mustT(t, os.Chmod(denied, 0755))
+	time.Sleep(50 * time.Millisecond)
+	file := filepath.Join(denied, "sub", "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, c, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+	tr := n.tree.(*internalTree)
+	tr.rw.RLock()
+	defer tr.rw.RUnlock()
+	if nd, err := tr.root.Get(root); err != nil || len(tr.skip) != 0 || nd.Watch[tr.retry] != 0 {
+		t.Fatalf("want no skipped directories; got %v (err=%v)", tr.skip, err)
+	}
+}
+
+func TestWatchExclUnlink(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+
+	c := make(chan EventInfo, 10)
+	mustT(t, n.WatchWith(tmpDir, c, []Option{WithExclUnlink()}, Remove|Write))
+	defer n.Stop(c)
+
+	f, err := os.Create(file)
+	mustT(t, err)
+	defer f.Close()
+	mustT(t, os.Remove(file))
+	waitEvent(t, c, Remove)
+	_, err = f.WriteString("abc")
+	mustT(t, err)
+	select {
+	case ev := <-c:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchAttrib(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	mustT(t, os.WriteFile(file, []byte("abc"), 0644))
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.Watch(tmpDir, c, Write|Chmod|Touch))
+	defer n.Stop(c)
+
+	mustT(t, os.Chmod(file, 0600))
+	old, new := waitEvent(t, c, Chmod).(Changer).Change()
+	if old == nil || old.Mode().Perm() != 0644 || new == nil || new.Mode().Perm() != 0600 {
+		t.Errorf("want Change()=(0644, 0600); got (%v, %v)", old, new)
+	}
+
+	mtime := time.Now().Add(-time.Hour)
+	mustT(t, os.Chtimes(file, mtime, mtime))
+	if _, new := waitEvent(t, c, Touch).(Changer).Change(); !new.ModTime().Equal(mtime) {
+		t.Errorf("want ModTime()=%v; got %v", mtime, new.ModTime())
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	mustT(t, err)
+	_, err = f.WriteString("def")
+	f.Close()
+	mustT(t, err)
+	if kind := waitEvent(t, c, Write).(Changer).WriteKind(); kind != WriteAppend {
+		t.Errorf("want WriteKind()=%v; got %v", WriteAppend, kind)
+	}
+
+	mustT(t, os.WriteFile(file, []byte("a"), 0600))
+	if kind := waitEvent(t, c, Write).(Changer).WriteKind(); kind != WriteTruncate {
+		t.Errorf("want WriteKind()=%v; got %v", WriteTruncate, kind)
+	}
+}
+
+func TestWatchRemoved(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	root, _, err := cleanpath(tmpDir)
+	mustT(t, err)
+	dir := filepath.Join(root, "dir")
+	mustT(t, os.Mkdir(dir, 0755))
+
+	c := make(chan EventInfo, 10)
+	mustT(t, n.Watch(dir, c, Create))
+	defer n.Stop(c)
+
+	mustT(t, os.Remove(dir))
+	if ev := waitEvent(t, c, WatchRemoved); ev.Path() != dir {
+		t.Fatalf("want WatchRemoved on %s; got %v", dir, ev)
+	}
+	tr := n.tree.(*internalTree)
+	tr.rw.RLock()
+	_, err = tr.root.Get(dir)
+	tr.rw.RUnlock()
+	if err == nil {
+		t.Errorf("want %s node to be pruned", dir)
+	}
+	tr.rw.RLock()
+	_, subs := tr.subs[c]
+	_, hold := tr.hold[c]
+	tr.rw.RUnlock()
+	if subs || hold {
+		t.Errorf("want c to be forgotten; got subs=%t, hold=%t", subs, hold)
+	}
+	in := tr.w.(*inotify)
+	in.RLock()
+	if len(in.m) != 0 {
+		t.Errorf("want len(m)=0; got %d", len(in.m))
+	}
+	in.RUnlock()
+
+	// Watching the path again must set up a new watch.
+	mustT(t, os.Mkdir(dir, 0755))
+	mustT(t, n.Watch(dir, c, Create))
+	file := filepath.Join(dir, "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, c, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+}
+
+func TestWatchFollowUnlink(t *testing.T) {
+	n, dir := newProxyTest(t)
+	var (
+		root  = filepath.Join(dir, "repo")
+		store = filepath.Join(dir, "store")
+		link  = filepath.Join(root, "pkg")
+	)
+	mustT(t, os.MkdirAll(root, 0755))
+	mustT(t, os.MkdirAll(filepath.Join(store, "sub"), 0755))
+	in := n.tree.(*internalTree).w.(*inotify)
+	watches := func() int {
+		in.RLock()
+		defer in.RUnlock()
+		return len(in.m)
+	}
+	mustT(t, os.Symlink(store, link))
+
+	c := watchProxy(t, n, filepath.Join(root, "..."), []Option{WithFollowSymlinks()}, Create)
+	if w := watches(); w != 3 {
+		t.Fatalf("want 3 inotify watches; got %d", w)
+	}
+
+	mustT(t, os.Remove(link))
+	collect(t, c, Create)
+	if w := watches(); w != 1 {
+		t.Fatalf("want 1 inotify watch after unlinking; got %d", w)
+	}
+
+	// Linking the target again watches it again.
+	mustT(t, os.Symlink(store, link))
+	collect(t, c, Create)
+	if w := watches(); w != 3 {
+		t.Fatalf("want 3 inotify watches after linking again; got %d", w)
+	}
+	mustT(t, os.WriteFile(filepath.Join(store, "sub", "file"), nil, 0644))
+	want := []string{
+		filepath.Join(link, "sub", "file"),
+		filepath.Join(store, "sub", "file"),
+	}
+	if got := collect(t, c, Create); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v; got %v", want, got)
+	}
 }
@@ -12,7 +12,9 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -276,6 +278,487 @@ func TestWatchWithExclude(t *testing.T) {
 	})
 }
 
+func TestEventInfoMetadata(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	root, _, err := cleanpath(tmpDir)
+	mustT(t, err)
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.Watch(tmpDir+"/...", c, Create))
+	defer n.Stop(c)
+
+	dir := filepath.Join(tmpDir, "dir")
+	mustT(t, os.Mkdir(dir, 0777))
+	time.Sleep(50 * time.Millisecond) // Need some time to watch dir.
+	mustT(t, os.WriteFile(filepath.Join(dir, "file"), []byte("abc"), 0666))
+
+	want := map[string]bool{
+		"dir":                        true,
+		filepath.Join("dir", "file"): false,
+	}
+	timeout := time.After(time.Second)
+	for len(want) != 0 {
+		select {
+		case ev := <-c:
+			isdir, ok := want[ev.Rel()]
+			if !ok {
+				t.Fatalf("unexpected event %v (rel=%s)", ev, ev.Rel())
+			}
+			if ev.Root() != root {
+				t.Errorf("want Root()=%s; got %s", root, ev.Root())
+			}
+			if ev.IsDir() != isdir {
+				t.Errorf("want IsDir()=%v; got %v (rel=%s)", isdir, ev.IsDir(), ev.Rel())
+			}
+			delete(want, ev.Rel())
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+func TestWatchWithStat(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+
+	c := make(chan EventInfo, 100)
+	nostat := make(chan EventInfo, 100)
+	mustT(t, n.WatchWith(tmpDir, c, []Option{WithStat()}, Create, Remove))
+	defer n.Stop(c)
+	mustT(t, n.Watch(tmpDir, nostat, Create))
+	defer n.Stop(nostat)
+
+	mustT(t, os.WriteFile(file, []byte("abc"), 0640))
+
+	ev := waitEvent(t, c, Create)
+	fi, err := ev.(Stater).Stat()
+	mustT(t, err)
+	if fi.Name() != "file" || fi.Mode().Perm() != 0640 {
+		t.Errorf("want Stat()=file (0640); got %s (%v)", fi.Name(), fi.Mode())
+	}
+	if ev, ok := waitEvent(t, nostat, Create).(Stater); ok {
+		t.Errorf("want %v not to implement Stater", ev)
+	}
+
+	mustT(t, os.Remove(file))
+
+	ev = waitEvent(t, c, Remove)
+	if _, err := ev.(Stater).Stat(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want Stat()=ErrNotExist; got %v", err)
+	}
+}
+
+func TestWatchChmod(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	mustT(t, os.WriteFile(file, []byte("abc"), 0644))
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.Watch(tmpDir, c, Chmod))
+	defer n.Stop(c)
+
+	mustT(t, os.Chmod(file, 0400))
+	if ev := waitEvent(t, c, Chmod); ev.Path() != file && !samefile(t, ev.Path(), file) {
+		t.Errorf("want Path()=%s; got %s", file, ev.Path())
+	}
+}
+
+func TestWatchOneshot(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	tmpDir := t.TempDir()
+
+	c := make(chan EventInfo, 10)
+	other := make(chan EventInfo, 10)
+	mustT(t, n.WatchWith(tmpDir, c, []Option{WithOneshot()}, Create))
+	mustT(t, n.Watch(tmpDir, other, Create))
+	defer n.Stop(other)
+
+	for _, name := range []string{"a", "b"} {
+		mustT(t, os.WriteFile(filepath.Join(tmpDir, name), nil, 0644))
+		waitEvent(t, other, Create)
+	}
+	if ev := waitEvent(t, c, Create); filepath.Base(ev.Path()) != "a" {
+		t.Errorf("want Path()=a; got %s", ev.Path())
+	}
+	select {
+	case ev := <-c:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchPersistent(t *testing.T) {
+	n, root := newProxyTest(t)
+	dir := filepath.Join(root, "a", "b")
+
+	c := watchProxy(t, n, dir, []Option{WithPersistent()}, Create)
+
+	for i := 0; i < 2; i++ {
+		mustT(t, os.MkdirAll(dir, 0755))
+		if ev := waitEvent(t, c, Create); ev.Path() != dir || !ev.IsDir() {
+			t.Fatalf("want Create on %s directory; got %v (i=%d)", dir, ev, i)
+		}
+		file := filepath.Join(dir, "file")
+		mustT(t, os.WriteFile(file, nil, 0644))
+		if ev := waitEvent(t, c, Create); ev.Path() != file {
+			t.Fatalf("want Create on %s; got %v (i=%d)", file, ev, i)
+		}
+		mustT(t, os.RemoveAll(filepath.Join(root, "a")))
+		time.Sleep(50 * time.Millisecond) // Need some time to re-arm.
+	}
+}
+
+func TestWatchPersistentRecursive(t *testing.T) {
+	n, root := newProxyTest(t)
+	dir := filepath.Join(root, "out")
+	mustT(t, os.Mkdir(dir, 0755))
+
+	c := watchProxy(t, n, dir+"/...", []Option{WithPersistent()}, Create|Remove)
+
+	mustT(t, os.RemoveAll(dir))
+	if ev := waitEvent(t, c, Remove); ev.Path() != dir {
+		t.Fatalf("want Remove on %s; got %v", dir, ev)
+	}
+	time.Sleep(50 * time.Millisecond) // Need some time to re-arm.
+	mustT(t, os.Mkdir(dir, 0755))
+	if ev := waitEvent(t, c, Create); ev.Path() != dir {
+		t.Fatalf("want Create on %s; got %v", dir, ev)
+	}
+	mustT(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	waitEvent(t, c, Create)
+	time.Sleep(50 * time.Millisecond) // Need some time to watch sub.
+	file := filepath.Join(dir, "sub", "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, c, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+}
+
+// failTree fails to set watches on the path while fail is set.
+type failTree struct {
+	tree
+	path string
+	fail atomic.Bool
+}
+
+var errWatchFail = errors.New("watch failed")
+
+func (t *failTree) Watch(path string, c chan<- EventInfo, o options, e ...Event) error {
+	if t.fail.Load() && path == t.path {
+		return errWatchFail
+	}
+	return t.tree.Watch(path, c, o, e...)
+}
+
+func TestWatchPersistentRearmFail(t *testing.T) {
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	dir := filepath.Join(root, "a")
+	mustT(t, os.Mkdir(dir, 0755))
+	tr := &failTree{tree: NewTree(), path: root}
+	t.Cleanup(func() { tr.Close() })
+
+	c := make(chan EventInfo, 100)
+	p, err := newPersistent(tr, dir, c, options{}, Create)
+	mustT(t, err)
+	t.Cleanup(p.Stop)
+
+	tr.fail.Store(true)
+	mustT(t, os.Remove(dir))
+	ev := waitEvent(t, c, WatchFailed)
+	if ev.Path() != dir || !errors.Is(ev.(Errorer).Err(), errWatchFail) {
+		t.Fatalf("want WatchFailed on %s with %v; got %v", dir, errWatchFail, ev)
+	}
+	tr.fail.Store(false)
+	mustT(t, os.Mkdir(dir, 0755))
+	if ev := waitEvent(t, c, Create); ev.Path() != dir {
+		t.Fatalf("want Create on %s; got %v", dir, ev)
+	}
+	file := filepath.Join(dir, "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, c, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+}
+
+func TestWatchWithConflict(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	dir := t.TempDir()
+	cases := []struct {
+		path string
+		opts []Option
+		err  error
+	}{
+		{dir + "/...", []Option{WithFollowSymlinks(), WithTrackSymlinks()}, errSymlinkOpts},
+		{dir, []Option{WithTrackSymlinks(), WithPersistent()}, errSymlinkOpts},
+		{dir + "/...", []Option{WithFollowSymlinks(), WithPersistent()}, errSymlinkOpts},
+		{dir, []Option{WithFollowSymlinks()}, errFollowPath},
+	}
+	for i, cas := range cases {
+		c := make(chan EventInfo, 1)
+		if err := n.WatchWith(cas.path, c, cas.opts, Create); err != cas.err {
+			t.Errorf("want err=%v; got %v (i=%d)", cas.err, err, i)
+		}
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	n, root := newProxyTest(t)
+	file := filepath.Join(root, "config.json")
+	mustT(t, os.WriteFile(file, []byte("{}"), 0644))
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.WatchFile(file, c, Create|Write|Remove))
+	defer n.Stop(c)
+
+	expect := func(e Event) {
+		t.Helper()
+		if ev := waitEvent(t, c, e); ev.Path() != file {
+			t.Fatalf("want %v on %s; got %v", e, file, ev)
+		}
+		select {
+		case ev := <-c:
+			t.Fatalf("want single event; got also %v", ev)
+		case <-time.After(4 * fileSettle):
+		}
+	}
+	// Saving by writing a temporary file and renaming it over the original one.
+	tmp := filepath.Join(root, ".config.json.swp")
+	mustT(t, os.WriteFile(tmp, []byte(`{"a":1}`), 0644))
+	mustT(t, os.Rename(tmp, file))
+	expect(Write)
+	// Saving by deleting and recreating the file.
+	mustT(t, os.Remove(file))
+	mustT(t, os.WriteFile(file, []byte(`{"a":2}`), 0644))
+	expect(Write)
+	// Saving in place.
+	mustT(t, os.WriteFile(file, []byte(`{"a":3}`), 0644))
+	expect(Write)
+	// Other files in the directory are not reported.
+	mustT(t, os.WriteFile(filepath.Join(root, "other"), nil, 0644))
+	select {
+	case ev := <-c:
+		t.Fatalf("want no event; got %v", ev)
+	case <-time.After(4 * fileSettle):
+	}
+	mustT(t, os.Remove(file))
+	expect(Remove)
+	mustT(t, os.WriteFile(file, nil, 0644))
+	expect(Create)
+}
+
+func TestWatchFileDir(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	c := make(chan EventInfo, 1)
+	if err := n.WatchFile(t.TempDir(), c, Write); err != errNotFile {
+		t.Fatalf("want err=%v; got %v", errNotFile, err)
+	}
+}
+
+func TestWatchMaxDepth(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	mustT(t, os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755))
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.WatchWith(filepath.Join(root, "..."), c, []Option{WithMaxDepth(1)}, Create))
+	defer n.Stop(c)
+	// Events of deeper directories watched by other channels are filtered.
+	all := make(chan EventInfo, 100)
+	mustT(t, n.Watch(filepath.Join(root, "..."), all, Create))
+	defer n.Stop(all)
+
+	for _, path := range []string{
+		filepath.Join(root, "file"),
+		filepath.Join(root, "a", "file"),
+		filepath.Join(root, "a", "b", "file"),
+		filepath.Join(root, "a", "b", "c", "file"),
+	} {
+		mustT(t, os.WriteFile(path, nil, 0644))
+	}
+	// Directories created after the Watch call are limited as well.
+	mustT(t, os.Mkdir(filepath.Join(root, "x"), 0755))
+	time.Sleep(50 * time.Millisecond) // Need some time to set the watch.
+	mustT(t, os.Mkdir(filepath.Join(root, "x", "y"), 0755))
+	time.Sleep(50 * time.Millisecond)
+	mustT(t, os.WriteFile(filepath.Join(root, "x", "file"), nil, 0644))
+	mustT(t, os.WriteFile(filepath.Join(root, "x", "y", "file"), nil, 0644))
+
+	want := map[string]bool{
+		filepath.Join(root, "file"):      true,
+		filepath.Join(root, "a", "file"): true,
+		filepath.Join(root, "x"):         true,
+		filepath.Join(root, "x", "file"): true,
+		filepath.Join(root, "x", "y"):    true,
+	}
+	// The directory at the depth limit was created before the Watch call.
+	boundary := filepath.Join(root, "a", "b")
+	timeout := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case ev := <-c:
+			if ev.Path() == boundary {
+				t.Fatalf("want no event on %s; got %v", boundary, ev)
+			}
+			if !want[ev.Path()] {
+				t.Fatalf("unexpected event %v", ev)
+			}
+			delete(want, ev.Path())
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	for path := range want {
+		t.Errorf("missing Create on %s", path)
+	}
+	if ev := waitEvent(t, all, Create); ev.Path() != filepath.Join(root, "file") {
+		t.Fatalf("want Create on %s; got %v", filepath.Join(root, "file"), ev)
+	}
+}
+
+func TestWatchNewDirScan(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+
+	c := make(chan EventInfo, 100)
+	mustT(t, n.Watch(filepath.Join(root, "..."), c, Create))
+	defer n.Stop(c)
+
+	// The subtree is created faster than the watches can be set on it.
+	mustT(t, os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755))
+	mustT(t, os.WriteFile(filepath.Join(root, "a", "b", "c", "file"), nil, 0644))
+	mustT(t, os.WriteFile(filepath.Join(root, "a", "file"), nil, 0644))
+
+	want := map[string]int{
+		filepath.Join(root, "a"):                   1,
+		filepath.Join(root, "a", "b"):              1,
+		filepath.Join(root, "a", "b", "c"):         1,
+		filepath.Join(root, "a", "b", "c", "file"): 1,
+		filepath.Join(root, "a", "file"):           1,
+	}
+	got := make(map[string]int)
+	timeout := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case ev := <-c:
+			got[ev.Path()]++
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want Create events %v; got %v", want, got)
+	}
+}
+
+func TestWatchInitialScan(t *testing.T) {
+	n := NewNotify()
+	defer n.Close()
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	mustT(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+	mustT(t, os.MkdirAll(filepath.Join(root, "skip"), 0755))
+	for _, path := range []string{
+		filepath.Join(root, "file"),
+		filepath.Join(root, "a", "file"),
+		filepath.Join(root, "a", "b", "file"),
+		filepath.Join(root, "skip", "file"),
+	} {
+		mustT(t, os.WriteFile(path, nil, 0644))
+	}
+
+	c := make(chan EventInfo, 100)
+	skip := func(path string) bool { return filepath.Base(path) == "skip" }
+	mustT(t, n.WatchWith(filepath.Join(root, "..."), c,
+		[]Option{WithInitialScan(), WithMaxDepth(1), WithFilter(skip)}, Create))
+	defer n.Stop(c)
+	mustT(t, os.WriteFile(filepath.Join(root, "live"), nil, 0644))
+
+	want := map[string]bool{
+		filepath.Join(root, "file"):      true,
+		filepath.Join(root, "a"):         true,
+		filepath.Join(root, "a", "file"): true,
+		filepath.Join(root, "a", "b"):    true,
+	}
+	for len(want) != 0 {
+		ev := waitEvent(t, c, Create)
+		if !want[ev.Path()] || !ev.(Replayer).Replayed() {
+			t.Fatalf("unexpected event %v", ev)
+		}
+		delete(want, ev.Path())
+	}
+	if ev := waitEvent(t, c, Synced); ev.Path() != root || ev.(Replayer).Replayed() {
+		t.Fatalf("want Synced on %s; got %v", root, ev)
+	}
+	ev := waitEvent(t, c, Create)
+	if ev.Path() != filepath.Join(root, "live") || ev.(Replayer).Replayed() {
+		t.Fatalf("want live Create on %s; got %v", filepath.Join(root, "live"), ev)
+	}
+
+	// A single file is reported itself.
+	file := make(chan EventInfo, 10)
+	mustT(t, n.WatchWith(filepath.Join(root, "file"), file, []Option{WithInitialScan()}, Write))
+	defer n.Stop(file)
+	if ev := waitEvent(t, file, Create); ev.Path() != filepath.Join(root, "file") {
+		t.Fatalf("want Create on %s; got %v", filepath.Join(root, "file"), ev)
+	}
+	waitEvent(t, file, Synced)
+}
+
+// newProxyTest gives a Notify instance, which is closed when the test ends,
+// and the canonical path of a temporary directory, for tests of the proxy
+// watchpoints.
+func newProxyTest(t *testing.T) (*Notify, string) {
+	t.Helper()
+	n := NewNotify()
+	t.Cleanup(func() { n.Close() })
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	return &n, dir
+}
+
+// watchProxy sets a watchpoint with the options on a new channel, which is
+// stopped when the test ends.
+func watchProxy(t *testing.T, n *Notify, path string, opts []Option, e Event) chan EventInfo {
+	t.Helper()
+	c := make(chan EventInfo, 100)
+	mustT(t, n.WatchWith(path, c, opts, e))
+	t.Cleanup(func() { n.Stop(c) })
+	return c
+}
+
+func waitEvent(t *testing.T, c <-chan EventInfo, e Event) EventInfo {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-c:
+			if ev.Event() == e {
+				return ev
+			}
+			t.Log(ev)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", e)
+			return nil
+		}
+	}
+}
+
 func mustT(t testing.TB, err error) {
 	t.Helper()
 	if err != nil {
@@ -0,0 +1,395 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// Option configures a single Watch call, see WatchWith.
+type Option func(*options)
+
+// options holds the settings of a single Watch call.
+type options struct {
+	doNotWatch DoNotWatchFn
+	stat       bool
+	oneshot    bool
+	persistent bool
+	track      bool
+	alias      bool
+	follow     bool
+	depth      int // see WithMaxDepth
+	bestEffort bool
+	scan       bool      // see WithInitialScan
+	flags      Event     // watcher behavior flags
+	progress   *progress // see WatchAsync
+}
+
+func newOptions(opts []Option) (o options) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+var (
+	errSymlinkOpts = errors.New("notify: WithFollowSymlinks, WithTrackSymlinks and WithPersistent cannot be combined")
+	errFollowPath  = errors.New("notify: WithFollowSymlinks requires a recursive path")
+)
+
+// check reports an error, if the options cannot be applied to a Watch call on
+// the given path.
+func (o options) check(path string) error {
+	n := 0
+	for _, set := range []bool{o.follow, o.track, o.persistent} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return errSymlinkOpts
+	case o.follow && !strings.HasSuffix(path, "..."):
+		return errFollowPath
+	}
+	return nil
+}
+
+// WithFilter makes the Watch call skip files and directories for which
+// doNotWatch returns true. See WatchWithFilter.
+func WithFilter(doNotWatch DoNotWatchFn) Option {
+	return func(o *options) {
+		o.doNotWatch = doNotWatch
+	}
+}
+
+// WithStat makes Notify lstat(2) the path of every event and attach the
+// result to the events sent to the channel. The result can be retrieved with
+// the Stater interface.
+//
+// The file is stat'ed when the event is dispatched, the first time it matches
+// a channel with WithStat set, not right after it was read, so the result may
+// reflect changes made in between. It is stat'ed once per event, regardless
+// of the number of channels that receive it.
+func WithStat() Option {
+	return func(o *options) {
+		o.stat = true
+	}
+}
+
+// WithOneshot makes Notify stop the channel right after the first event was
+// sent to it, as if Stop was called. The channel receives no more than one
+// event, even if it was passed to several Watch calls.
+func WithOneshot() Option {
+	return func(o *options) {
+		o.oneshot = true
+	}
+}
+
+// WithPersistent makes the watchpoint survive removal of the watched path.
+// The path does not need to exist when Watch is called. While it is missing,
+// its nearest existing ancestor is watched instead. Each time the path appears,
+// the watch is set up again, including the whole subtree for recursive paths,
+// and a Create event for the path is sent to the channel, regardless of the
+// requested event set.
+//
+// Removal of the path is detected from the path itself, thus renaming any of
+// its ancestors does not re-arm the watch. If setting up the watch again fails,
+// it is retried with backoff, and WatchFailed is sent after several attempts.
+func WithPersistent() Option {
+	return func(o *options) {
+		o.persistent = true
+	}
+}
+
+// WithTrackSymlinks makes the watchpoint follow the symbolic links found on
+// the watched path. Notify resolves symlinks once, when Watch is called, thus
+// by default it keeps watching the old target after a link was changed. With
+// this option the links are watched as well, and when any of them changes, the
+// watch is moved to the new target. Write, Create and Remove events are then
+// sent for the files of the new target, which content differs from the old one,
+// as far as the watched event set includes them. E.g. it detects updates of
+// Kubernetes ConfigMap and Secret volumes, done by swapping the ..data symlink.
+//
+// Like all events, the ones sent for the swap carry the resolved paths.
+// Events of the old target, which were not delivered before the swap was
+// detected, are dropped.
+// The option cannot be combined with WithPersistent nor WithFollowSymlinks,
+// WatchWith fails if it is.
+func WithTrackSymlinks() Option {
+	return func(o *options) {
+		o.track = true
+	}
+}
+
+// WithFollowSymlinks makes a recursive Watch call descend into symlinked
+// directories. Targets of the symlinks are watched as well, and events are
+// reported under their real paths and additionally under each path they can be
+// reached by through the symlinks. Each directory is watched once, even if
+// several symlinks lead to it, and symlink cycles are reported once.
+//
+// Symlinks created after the Watch call are followed as they appear. Targets,
+// which contain the watched directory itself, are not watched, only events
+// of the watched directory are reported under their paths.
+//
+// The option requires a recursive path, as Watch follows the symlinks found on
+// a non-recursive path itself, and WatchWith fails otherwise. It cannot be
+// combined with WithTrackSymlinks nor WithPersistent.
+func WithFollowSymlinks() Option {
+	return func(o *options) {
+		o.follow = true
+	}
+}
+
+// WithMaxDepth limits a recursive Watch call to the given number of directory
+// levels below the watched directory, e.g. with depth 1 the directory and its
+// direct subdirectories are watched. Directories created deeper than the limit
+// are not watched, and events reported for them by other watchpoints are not
+// sent to the channel. Non-positive depth means no limit, which is the default.
+//
+// If the channel is passed to several recursive Watch calls on the same path,
+// the greatest limit applies. Watchers, which watch whole trees natively, like
+// FSEvents and ReadDirectoryChangesW, only filter the events.
+func WithMaxDepth(depth int) Option {
+	return func(o *options) {
+		o.depth = depth
+	}
+}
+
+// WithBestEffort makes a recursive Watch call skip the directories, which
+// cannot be read or watched, e.g. due to missing permissions or because they
+// vanished during the walk, instead of failing. The watchpoint is set for the
+// rest of the tree, and an *AddDirError listing the skipped directories is
+// returned.
+//
+// Skipped directories are retried when their permissions change. Directories
+// created after the Watch call are always added this way. The option is
+// a nop for watchers, which watch whole trees natively.
+func WithBestEffort() Option {
+	return func(o *options) {
+		o.bestEffort = true
+	}
+}
+
+// WithInitialScan makes Watch send a Create event for every entry, which
+// exists under the watched path, as if it was just created. Recursive paths
+// are scanned up to the depth set with WithMaxDepth, and entries excluded with
+// WithFilter or Exclude are skipped. A path of a single file is reported itself.
+// The replayed events can be told apart from live ones with the Replayer
+// interface. After the last of them, the Synced event is sent.
+//
+// The watch is set before the scan starts, so no change goes unnoticed. The
+// scan is not atomic with live events: they may be sent before Synced, even
+// before or among the replayed events, and changes made during the scan may
+// be reported twice, both by the scan and by a live event.
+//
+// The events are sent to the channel as all the others, thus the caller must
+// ensure it has sufficient buffer space or receive from it concurrently.
+func WithInitialScan() Option {
+	return func(o *options) {
+		o.scan = true
+	}
+}
+
+// WithAlias makes Notify report the paths of events with the spelling used
+// in the Watch call, instead of the one with all the symlinks resolved. E.g. a
+// watch on /srv/app/current/..., where current is a symlink to releases/42,
+// reports events for /srv/app/current/... rather than /srv/app/releases/42/...
+//
+// Paths are rewritten for c only, other channels watching the same paths are
+// not affected. If c was passed to several Watch calls with the option, the
+// longest matching path is used. Events sent by WithPersistent, WithTrackSymlinks,
+// WithFollowSymlinks and WatchFile carry the resolved paths.
+func WithAlias() Option {
+	return func(o *options) {
+		o.alias = true
+	}
+}
+
+// aliaspath gives the spelling of the path passed to Watch, which is used
+// by WithAlias.
+func aliaspath(path string) string {
+	path = strings.TrimSuffix(path, "...")
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// The inotify behavior flags (IN_ONLYDIR, IN_DONT_FOLLOW, IN_EXCL_UNLINK and
+// IN_ONESHOT) are deliberately not exported as Event values. They are not
+// events and would not combine with the event sets of other platforms, so
+// they are set per Watch call with WithOnlyDir, WithDontFollow,
+// WithExclUnlink and WithOneshot instead. IN_MASK_ADD is not exposed at all,
+// as the tree always passes the joint event set of all watchpoints.
+
+// WithOnlyDir makes the Watch call fail if the path, or any directory found
+// during a recursive walk, is not a directory at the time the watch is set.
+// It guards recursive watches against races, where a directory is replaced
+// with a file while it is being watched.
+//
+// It is implemented only by inotify (IN_ONLYDIR) and is a nop elsewhere.
+func WithOnlyDir() Option {
+	return func(o *options) {
+		o.flags |= onlyDir
+	}
+}
+
+// WithDontFollow makes the Watch call watch the symbolic link itself instead
+// of the file it points to, if the path is a symbolic link.
+//
+// It is implemented only by inotify (IN_DONT_FOLLOW) and is a nop elsewhere.
+func WithDontFollow() Option {
+	return func(o *options) {
+		o.flags |= dontFollow
+	}
+}
+
+// WithExclUnlink stops reporting events for children of the watched directory
+// after they were unlinked, e.g. writes to a temporary file, which was removed
+// right after it was opened.
+//
+// It is implemented only by inotify (IN_EXCL_UNLINK) and is a nop elsewhere.
+func WithExclUnlink() Option {
+	return func(o *options) {
+		o.flags |= exclUnlink
+	}
+}
+
+// subscription holds the settings of a user channel. A channel passed to
+// several Watch calls has the settings of all the calls joined.
+type subscription struct {
+	stat    bool
+	oneshot bool
+	fired   bool              // whether oneshot channel already received its event
+	aliases map[string]string // resolved watchpoint paths to the Watch paths, see WithAlias
+}
+
+// rewrite replaces the resolved prefix of path with its alias. It reports
+// false if no alias matches the path.
+func (sub *subscription) rewrite(path string) (string, bool) {
+	real, ok := sub.match(path)
+	if !ok {
+		return path, false
+	}
+	return sub.aliases[real] + path[len(real):], true
+}
+
+// match gives the longest resolved path, which has an alias and which is
+// the path itself or its ancestor.
+func (sub *subscription) match(path string) (real string, ok bool) {
+	for r := range sub.aliases {
+		if (path == r || indexrel(r, path) != -1) && len(r) > len(real) {
+			real = r
+		}
+	}
+	return real, real != ""
+}
+
+// subscriptions maps user channels to their settings. It is guarded by the
+// tree lock.
+type subscriptions map[chan<- EventInfo]*subscription
+
+// Add joins o with the settings of c.
+func (s subscriptions) Add(c chan<- EventInfo, o options) {
+	sub, ok := s[c]
+	if !ok {
+		sub = &subscription{}
+		s[c] = sub
+	}
+	sub.stat = sub.stat || o.stat
+	sub.oneshot = sub.oneshot || o.oneshot
+}
+
+// Alias makes events of c, which were reported under the real path, use path
+// instead. See WithAlias.
+func (s subscriptions) Alias(c chan<- EventInfo, real, path string) {
+	sub, ok := s[c]
+	if !ok || real == path {
+		return
+	}
+	if sub.aliases == nil {
+		sub.aliases = make(map[string]string)
+	}
+	sub.aliases[real] = path
+}
+
+// Unalias removes the alias of the watchpoint of c set on the real path, once
+// the path is no longer watched.
+func (s subscriptions) Unalias(c chan<- EventInfo, real string) {
+	if sub, ok := s[c]; ok {
+		delete(sub.aliases, real)
+	}
+}
+
+// Del removes the settings of c.
+func (s subscriptions) Del(c chan<- EventInfo) {
+	delete(s, c)
+}
+
+// Sender gives a sender for a single event, which passes the event to send.
+// It must be used with the tree lock held for reading.
+func (s subscriptions) Sender(send sendFunc) *sender {
+	return &sender{subs: s, send: send}
+}
+
+// sender applies per channel settings to a single event before it is sent.
+type sender struct {
+	subs  subscriptions
+	send  sendFunc
+	st    *snapshot
+	fired []chan<- EventInfo // oneshot channels, which are to be stopped
+	sent  int                // number of channels the event was sent to
+}
+
+// Reset prepares the sender for the next event, so it is reused instead of
+// allocating a new one. The fired channels it gave before are reused as well.
+func (s *sender) Reset() {
+	s.st, s.fired, s.sent = nil, s.fired[:0], 0
+}
+
+// Send is a sendFunc.
+func (s *sender) Send(c chan<- EventInfo, ei EventInfo) {
+	m, ok := ei.(*matched)
+	if !ok {
+		s.sent++
+		s.send(c, ei)
+		return
+	}
+	sub := s.subs[c]
+	if sub == nil {
+		s.sent++
+		s.send(c, m.export())
+		return
+	}
+	if sub.oneshot {
+		if sub.fired {
+			return
+		}
+		sub.fired = true
+		s.fired = append(s.fired, c)
+	}
+	if sub.stat {
+		if s.st == nil {
+			s.st = newSnapshot(ei.Path())
+		}
+		m = &matched{EventInfo: m.EventInfo, root: m.root, st: s.st, ch: m.ch}
+	}
+	if len(sub.aliases) != 0 {
+		// The alias is applied only if it covers the root of the
+		// watchpoint, so that Rel stays relative.
+		if real, ok := sub.match(m.root); ok {
+			alias, path := sub.aliases[real], m.EventInfo.Path()
+			if path == real || indexrel(real, path) != -1 {
+				m = &matched{EventInfo: m.EventInfo, root: m.root, st: m.st, ch: m.ch,
+					alias: &aliased{path: alias + path[len(real):], root: alias + m.root[len(real):]}}
+			}
+		}
+	}
+	s.sent++
+	s.send(c, m.export())
+}
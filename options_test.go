@@ -0,0 +1,54 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSubscriptionRewrite(t *testing.T) {
+	p := filepath.FromSlash
+	s := make(subscriptions)
+	c := make(chan EventInfo)
+	s.Add(c, options{alias: true})
+	s.Alias(c, p("/srv/releases/42"), p("/srv/current"))
+	s.Alias(c, p("/srv/releases/42/lib"), p("/srv/lib"))
+	s.Alias(c, p("/private/tmp"), p("/private/tmp"))
+	cases := [...]struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{p("/srv/releases/42"), p("/srv/current"), true},
+		{p("/srv/releases/42/main.go"), p("/srv/current/main.go"), true},
+		{p("/srv/releases/42/lib/a.go"), p("/srv/lib/a.go"), true},
+		{p("/srv/releases/421/main.go"), p("/srv/releases/421/main.go"), false},
+		{p("/private/tmp/a"), p("/private/tmp/a"), false},
+	}
+	for i, cas := range cases {
+		got, ok := s[c].rewrite(cas.path)
+		if got != cas.want || ok != cas.ok {
+			t.Errorf("want rewrite(%q)=(%q, %v); got (%q, %v) (i=%d)",
+				cas.path, cas.want, cas.ok, got, ok, i)
+		}
+	}
+}
+
+func TestSubscriptionUnalias(t *testing.T) {
+	p := filepath.FromSlash
+	s := make(subscriptions)
+	c := make(chan EventInfo)
+	s.Add(c, options{alias: true})
+	s.Alias(c, p("/srv/releases/42"), p("/srv/current"))
+	s.Alias(c, p("/srv/releases/42/lib"), p("/srv/lib"))
+	s.Unalias(c, p("/srv/releases/42/lib"))
+	if n := len(s[c].aliases); n != 1 {
+		t.Fatalf("want len(aliases)=1; got %d", n)
+	}
+	if got, _ := s[c].rewrite(p("/srv/releases/42/lib/a.go")); got != p("/srv/current/lib/a.go") {
+		t.Errorf("want rewrite to use the remaining alias; got %q", got)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// persistent is a watchpoint, which outlives the path it was set on. While
+// the path does not exist, the nearest existing ancestor is watched for Create
+// events instead. Once the path appears, the real watch is set up again.
+//
+// The real watch is set on a proxy channel, which is owned by persistent, so
+// it can be torn down without affecting other watchpoints of the user channel.
+type persistent struct {
+	relay
+	t      tree
+	path   string // absolute path of the Watch call, without "..."
+	isrec  bool
+	o      options
+	events Event
+	pc     chan EventInfo // proxy channel of the real watch
+	mc     chan EventInfo // channel watching for the path to appear or vanish
+	target string         // canonical form of path
+	dir    string         // canonical form of the nearest existing ancestor
+	armed  bool           // whether the real watch is set
+	retry  *time.Timer    // set while re-arming the watch failed
+	fails  int            // number of failed attempts to re-arm the watch
+}
+
+func newPersistent(t tree, path string, c chan<- EventInfo, o options,
+	events Event) (*persistent, error) {
+	p := &persistent{
+		t:      t,
+		relay:  relay{c: c},
+		o:      o,
+		events: events,
+		pc:     make(chan EventInfo, buffer),
+		mc:     make(chan EventInfo, buffer),
+	}
+	if strings.HasSuffix(path, "...") {
+		p.isrec = true
+		path = path[:len(path)-3]
+	}
+	var err error
+	if p.path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+	if err = p.arm(); err != nil {
+		return nil, err
+	}
+	p.start(p.loop)
+	return p, nil
+}
+
+// resolve finds the nearest existing ancestor of the path and gives its
+// canonical form together with the canonical form of the path.
+func (p *persistent) resolve() (dir, target string, err error) {
+	dir, rest := p.path, ""
+	for {
+		if _, err = os.Lstat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", err
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+	if dir, err = canonical(dir); err != nil {
+		return "", "", err
+	}
+	return dir, filepath.Join(dir, rest), nil
+}
+
+// arm sets the real watch if the path exists, otherwise it watches the nearest
+// existing ancestor for the path to appear.
+func (p *persistent) arm() error {
+	for {
+		dir, target, err := p.resolve()
+		if err != nil {
+			return err
+		}
+		p.dir, p.target = dir, target
+		if dir == target {
+			path := target
+			if p.isrec {
+				path = filepath.Join(target, "...")
+			}
+			if err = p.t.Watch(path, p.pc, p.o, p.events); err == nil {
+				if err = p.t.Watch(target, p.mc, options{}, Remove|Rename); err != nil {
+					p.t.Stop(p.pc)
+				}
+			}
+			switch {
+			case os.IsNotExist(err): // The path has vanished in the meantime.
+				continue
+			case err != nil:
+				return err
+			}
+			p.armed = true
+			return nil
+		}
+		switch err = p.t.Watch(dir, p.mc, options{}, Create|Remove|Rename); {
+		case os.IsNotExist(err): // The ancestor has vanished in the meantime.
+			continue
+		case err != nil:
+			return err
+		}
+		// The path may have been created before the watch was set.
+		if _, err := os.Lstat(p.path); err == nil {
+			p.t.Stop(p.mc)
+			continue
+		}
+		p.armed = false
+		return nil
+	}
+}
+
+// disarm removes the real watch and forwards the events it has already
+// delivered.
+func (p *persistent) disarm() {
+	if p.armed {
+		p.t.Stop(p.pc)
+		p.drain()
+	}
+	p.t.Stop(p.mc)
+	p.armed = false
+}
+
+func (p *persistent) loop() {
+	for {
+		var retry <-chan time.Time
+		if p.retry != nil {
+			retry = p.retry.C
+		}
+		select {
+		case <-p.quit:
+			return
+		case ei := <-p.pc:
+			p.send(ei)
+		case ei := <-p.mc:
+			p.update(ei)
+		case <-retry:
+			p.rearm()
+		}
+	}
+}
+
+// update re-arms the watch, when the path or its watched ancestor vanishes,
+// or any of the missing ancestors is created.
+func (p *persistent) update(ei EventInfo) {
+	switch e := ei.Event(); {
+	case p.armed && ei.Path() == p.target && e&(Remove|Rename|watchLost) != 0:
+	case !p.armed && ei.Path() == p.dir && e&(Remove|Rename|watchLost) != 0:
+	case !p.armed && e == Create && (ei.Path() == p.target ||
+		strings.HasPrefix(p.target, ei.Path()+sep)):
+	default:
+		return
+	}
+	p.rearm()
+}
+
+// rearm sets the watch again. If that fails, it is retried with backoff like
+// the directories skipped by the tree, and the channel is sent WatchFailed
+// after retryReport failed attempts. Nothing is watched in the meantime.
+func (p *persistent) rearm() {
+	p.disarm()
+	if err := p.arm(); err != nil {
+		dbgprintf("persistent(%q) error: %v", p.path, err)
+		if p.fails++; p.fails == retryReport {
+			ei := newSynthetic(p.path, WatchFailed, false)
+			ei.err = err
+			p.send(newMatched(ei, p.path).export())
+		}
+		p.retry = time.NewTimer(backoff(p.fails))
+		return
+	}
+	p.retry, p.fails = nil, 0
+	if p.armed {
+		fi, err := os.Lstat(p.target)
+		ei := newSynthetic(p.target, Create, err == nil && fi.IsDir())
+		p.send(newMatched(ei, p.target).export())
+	}
+}
+
+func (p *persistent) drain() {
+	for {
+		select {
+		case ei := <-p.pc:
+			p.send(ei)
+		default:
+			return
+		}
+	}
+}
+
+// Stop removes the watches and waits until no more events are sent to the
+// user channel.
+func (p *persistent) Stop() {
+	p.stop()
+	if p.retry != nil {
+		p.retry.Stop()
+	}
+	p.t.Stop(p.pc)
+	p.t.Stop(p.mc)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import "sync"
+
+// proxy is a watchpoint, which is maintained by Notify on behalf of a user
+// channel, on top of the watchpoints of the tree.
+type proxy interface {
+	// Stop removes the watchpoint and waits until no more events are sent
+	// to the user channel.
+	Stop()
+}
+
+// proxies holds proxy watchpoints of user channels.
+type proxies struct {
+	mu sync.Mutex // protects m
+	m  map[chan<- EventInfo][]proxy
+}
+
+func newProxies() *proxies {
+	return &proxies{m: make(map[chan<- EventInfo][]proxy)}
+}
+
+// Add registers a proxy watchpoint of c.
+func (ps *proxies) Add(c chan<- EventInfo, p proxy) {
+	ps.mu.Lock()
+	ps.m[c] = append(ps.m[c], p)
+	ps.mu.Unlock()
+}
+
+// Del unregisters the proxy watchpoint p of c, without stopping it.
+func (ps *proxies) Del(c chan<- EventInfo, p proxy) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i, q := range ps.m[c] {
+		if q == p {
+			ps.m[c] = append(ps.m[c][:i], ps.m[c][i+1:]...)
+			break
+		}
+	}
+	if len(ps.m[c]) == 0 {
+		delete(ps.m, c)
+	}
+}
+
+// Stop stops proxy watchpoints of c. If c is nil, all of them are stopped.
+func (ps *proxies) Stop(c chan<- EventInfo) {
+	ps.mu.Lock()
+	var stop []proxy
+	for ch, p := range ps.m {
+		if c == nil || ch == c {
+			stop = append(stop, p...)
+			delete(ps.m, ch)
+		}
+	}
+	ps.mu.Unlock()
+	for _, p := range stop {
+		p.Stop()
+	}
+}
+
+// relay is embedded by the proxy watchpoints. It runs the goroutines, which
+// handle the events of their watches, and sends the events to the user
+// channel.
+type relay struct {
+	c    chan<- EventInfo
+	quit chan struct{} // closed by stop
+	wg   sync.WaitGroup
+}
+
+// start runs loop in a goroutine. The loop is to return once quit is closed.
+func (r *relay) start(loop func()) {
+	if r.quit == nil {
+		r.quit = make(chan struct{})
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		loop()
+	}()
+}
+
+// stop makes the goroutines return and waits for them.
+func (r *relay) stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// send sends ei to the user channel. Like the tree does, it drops the event
+// if the receiver is too slow.
+func (r *relay) send(ei EventInfo) {
+	select {
+	case r.c <- ei:
+	default:
+		dbgprintf("dropped %s on %q: receiver too slow", ei.Event(), ei.Path())
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// replay sends to c a Create event for every entry found under the path of
+// a Watch call, followed by the Synced event. See WithInitialScan.
+//
+// It must be called after the watch was set, with the tree lock released. The
+// path is walked off the lock, which is taken only to apply the settings of c
+// to each batch of dispatchBatch events, and the batch is sent after the lock
+// is released again. Thus replay is not atomic with live events of c, which
+// may be sent before, among or after the replayed ones. Replaying ends early,
+// if c is stopped in the meantime. It gives oneshot channels, which are to be
+// stopped.
+func replay(path string, isrec bool, c chan<- EventInfo, o options, w watcher,
+	rw *sync.RWMutex, subs subscriptions, send sendFunc) (fired []chan<- EventInfo) {
+	var (
+		batch   []*synthetic
+		out     []delivery
+		stopped bool
+	)
+	queue := func(c chan<- EventInfo, ei EventInfo) {
+		out = append(out, delivery{c: c, ei: ei})
+	}
+	snd := subs.Sender(queue)
+	flush := func() {
+		rw.Lock()
+		// The subscription of c is gone, if c was stopped.
+		_, ok := subs[c]
+		for _, ei := range batch {
+			if ok && (ei.event == Synced || !isExcluded(w, ei.path)) {
+				snd.Reset()
+				snd.Send(c, newMatched(ei, path))
+				fired = append(fired, snd.fired...)
+			}
+		}
+		stopped = !ok
+		rw.Unlock()
+		for _, dv := range out {
+			send(dv.c, dv.ei)
+		}
+		batch, out = batch[:0], out[:0]
+	}
+	emit := func(p string, e Event, isdir, replayed bool) {
+		ei := newSynthetic(p, e, isdir)
+		ei.replayed = replayed
+		if batch = append(batch, ei); len(batch) == dispatchBatch {
+			flush()
+		}
+	}
+	var isdir bool
+	fn := func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case stopped:
+			return filepath.SkipAll
+		case err != nil:
+			dbgprintf("replay(%q) error: %v", p, err)
+			return nil
+		case p == path:
+			if isdir = d.IsDir(); !isdir {
+				emit(p, Create, false, true)
+			}
+			return nil
+		case o.doNotWatch != nil && o.doNotWatch(p):
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		emit(p, Create, d.IsDir(), true)
+		if d.IsDir() && (!isrec || (o.depth > 0 && level(path, p) > o.depth)) {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	filepath.WalkDir(path, fn)
+	if !stopped {
+		emit(path, Synced, isdir, false)
+		flush()
+	}
+	return fired
+}
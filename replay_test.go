@@ -0,0 +1,54 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayUnlocked(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	for i := 0; i < 2*dispatchBatch; i++ {
+		mustT(t, os.WriteFile(filepath.Join(dir, strconv.Itoa(i)), nil, 0644))
+	}
+	var rw sync.RWMutex
+	c := make(chan EventInfo)
+	subs := make(subscriptions)
+	subs.Add(c, options{})
+	sent := make(chan EventInfo)
+	send := func(_ chan<- EventInfo, ei EventInfo) { sent <- ei }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replay(dir, true, c, options{}, nil, &rw, subs, send)
+	}()
+	for n := 1; n <= dispatchBatch; n++ {
+		if n == dispatchBatch {
+			// Stopping c ends replaying after the batch, which is being sent.
+			rw.Lock()
+			subs.Del(c)
+			rw.Unlock()
+		}
+		ei := <-sent
+		// Sends, which block, do not hold the lock.
+		if !rw.TryLock() {
+			t.Fatalf("want the lock released while %v is sent", ei)
+		}
+		rw.Unlock()
+	}
+	select {
+	case <-done:
+	case ei := <-sent:
+		t.Fatalf("want replaying to end after %d events; got %v", dispatchBatch, ei)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package notify
+
+import "sync"
+
+// ringSize is the number of batches, which a new ring holds before it grows.
+const ringSize = 16
+
+// ringMax is the number of events, above which the reader waits for the
+// consumer. It is a few times the default limit of events queued by the kernel
+// (/proc/sys/fs/inotify/max_queued_events), so the kernel queue is drained
+// even if the consumer falls behind by a whole kernel queue.
+const ringMax = 1 << 16
+
+// ring is a queue of batches read from the inotify descriptor, which wait for
+// the consumer. It grows as needed, so the reader does not wait for the
+// consumer, unless more than max events are queued.
+type ring struct {
+	mu       sync.Mutex
+	nonempty sync.Cond
+	nonfull  sync.Cond
+	buf      []*readBatch // circular, holds n batches starting at head
+	head, n  int
+	events   int // number of events queued
+	max      int
+	peak     int // the greatest number of events queued
+	stalls   int // number of batches, which waited for the consumer
+	closed   bool
+}
+
+func newRing(size, max int) *ring {
+	r := &ring{buf: make([]*readBatch, size), max: max}
+	r.nonempty.L, r.nonfull.L = &r.mu, &r.mu
+	return r
+}
+
+// full reports whether the batch is to wait before being queued. A batch is
+// always queued into an empty ring, however large it is.
+func (r *ring) full(b *readBatch) bool {
+	return r.n != 0 && r.events+len(b.raw) > r.max && !r.closed
+}
+
+// Push queues the batch. It reports false if the ring was closed.
+func (r *ring) Push(b *readBatch) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full(b) {
+		r.stalls++
+		for r.full(b) {
+			r.nonfull.Wait()
+		}
+	}
+	if r.closed {
+		return false
+	}
+	if r.n == len(r.buf) {
+		buf := make([]*readBatch, 2*len(r.buf))
+		n := copy(buf, r.buf[r.head:])
+		copy(buf[n:], r.buf[:r.head])
+		r.buf, r.head = buf, 0
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = b
+	r.n++
+	r.events += len(b.raw)
+	r.peak = max(r.peak, r.events)
+	r.nonempty.Signal()
+	return true
+}
+
+// Pop dequeues the oldest batch, waiting for one if the ring is empty. It
+// reports false once the ring was closed, the batches left are dropped then.
+func (r *ring) Pop() (*readBatch, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.n == 0 && !r.closed {
+		r.nonempty.Wait()
+	}
+	if r.closed {
+		return nil, false
+	}
+	b := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	r.events -= len(b.raw)
+	r.nonfull.Signal()
+	return b, true
+}
+
+// Close wakes up both the reader and the consumer, if any of them waits.
+func (r *ring) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.nonempty.Broadcast()
+	r.nonfull.Broadcast()
+}
+
+// Stats fills in the state of the ring.
+func (r *ring) Stats(q *Queue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q.Len, q.Peak, q.Batches, q.Cap, q.Stalls = r.events, r.peak, r.n, len(r.buf), r.stalls
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seenTTL is how long an entry reported by scan awaits its real Create event.
+// The watch of the directory is set before scan reads it, thus the event, if
+// any, is already queued by then and arrives shortly after.
+const seenTTL = time.Second
+
+// seenSet holds the entries reported by scan, awaiting their Create events,
+// by the time they expire. It has its own lock, so dispatch consults it under
+// the read lock of the tree, and does not lock anything while it is empty.
+type seenSet struct {
+	n     atomic.Int64 // len(m)
+	mu    sync.Mutex   // protects m and sweep
+	m     map[string]time.Time
+	sweep time.Time // when the expired entries are dropped next
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{m: make(map[string]time.Time)}
+}
+
+// Add records the entry, it reports false if the entry was already recorded.
+func (s *seenSet) Add(path string) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	if _, ok := s.m[path]; ok {
+		return false
+	}
+	s.m[path] = now.Add(seenTTL)
+	s.n.Store(int64(len(s.m)))
+	return true
+}
+
+// Scanned reports whether ei is a Create event of an entry, which was already
+// reported by scan. Entries, which are removed or renamed, are forgotten, so
+// creating them again is reported.
+func (s *seenSet) Scanned(ei EventInfo) bool {
+	e := ei.Event()
+	if e&(Create|Remove|Rename) == 0 || s.n.Load() == 0 {
+		return false
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	defer func() { s.n.Store(int64(len(s.m))) }()
+	if e == Create {
+		exp, ok := s.m[ei.Path()]
+		delete(s.m, ei.Path())
+		return ok && now.Before(exp)
+	}
+	delete(s.m, ei.Path())
+	isdir := true
+	if d, ok := ei.(isDirer); ok {
+		if ok, err := d.isDir(); err == nil {
+			isdir = ok
+		}
+	}
+	if isdir {
+		// Entries below the directory are gone as well.
+		s.del(func(name string) bool { return indexrel(ei.Path(), name) != -1 })
+	}
+	return false
+}
+
+// Forget drops the entries for which drop returns true.
+func (s *seenSet) Forget(drop func(name string) bool) {
+	s.mu.Lock()
+	s.del(drop)
+	s.n.Store(int64(len(s.m)))
+	s.mu.Unlock()
+}
+
+func (s *seenSet) del(drop func(name string) bool) {
+	for name := range s.m {
+		if drop(name) {
+			delete(s.m, name)
+		}
+	}
+}
+
+// expire drops the expired entries, at most once per seenTTL.
+func (s *seenSet) expire(now time.Time) {
+	if len(s.m) == 0 || now.Before(s.sweep) {
+		return
+	}
+	s.sweep = now.Add(seenTTL)
+	s.del(func(name string) bool { return !now.Before(s.m[name]) })
+	s.n.Store(int64(len(s.m)))
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet()
+	for _, path := range []string{"/a", "/a/b", "/a/b/c", "/ab", "/old"} {
+		if !s.Add(path) {
+			t.Fatalf("want %s to be added", path)
+		}
+	}
+	if s.Add("/a") {
+		t.Error("want /a to be added once")
+	}
+	s.m["/old"] = time.Now().Add(-time.Second)
+	if s.Scanned(&Call{P: "/old", E: Create}) {
+		t.Error("want expired /old to be forgotten")
+	}
+	if s.Scanned(&Call{P: "/ab", E: Write}) {
+		t.Error("want Write not to be reported as scanned")
+	}
+	s.Scanned(&Call{P: "/a/b", E: Remove, Dir: true})
+	if !s.Scanned(&Call{P: "/a", E: Create}) {
+		t.Error("want Create of /a to be reported as scanned")
+	}
+	if s.Scanned(&Call{P: "/a/b/c", E: Create}) {
+		t.Error("want /a/b/c to be forgotten with its parent")
+	}
+	if !s.Scanned(&Call{P: "/ab", E: Create}) {
+		t.Error("want Create of /ab to be reported as scanned")
+	}
+	if n := s.n.Load(); n != 0 || len(s.m) != 0 {
+		t.Errorf("want empty set; got n=%d, len(m)=%d", n, len(s.m))
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import "time"
+
+// Stats describes the state of the watches of a Notify instance. See
+// Notify.Stats.
+type Stats struct {
+	// Degraded lists the directories within recursive watchpoints, which
+	// could not be watched and are being retried, sorted by their paths.
+	Degraded []Degraded
+
+	// Queue describes the events read from the system, which wait to be
+	// dispatched. It is zero for watchers, which do not queue events.
+	Queue Queue
+}
+
+// Queue describes the queue of events between the goroutine reading them
+// from the system and the one dispatching them. The reader does not wait for
+// the dispatching one, unless the queue is full, so the system queue is
+// drained promptly, even if the events are dispatched slowly.
+type Queue struct {
+	Len       int // events queued
+	Peak      int // the greatest Len so far
+	Batches   int // batches of events queued, each read at once
+	Cap       int // batches the queue holds before it grows
+	Stalls    int // batches, which waited for the queue to be no longer full
+	Overflows int // times the system queue overflowed and events were lost
+	ReadSize  int // size of the buffer the events are read into, in bytes
+}
+
+// Degraded is a directory, which could not be watched.
+type Degraded struct {
+	Path     string
+	Err      error     // error of the last attempt
+	Attempts int       // number of failed attempts
+	Next     time.Time // time of the next attempt
+}
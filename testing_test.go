@@ -55,7 +55,7 @@ func NewChans(n int) Chans {
 
 func (c Chans) Foreach(fn func(chan<- EventInfo, node)) {
 	for i, ch := range c {
-		fn(ch, node{Name: strconv.Itoa(i)})
+		fn(ch, newnode(strconv.Itoa(i)))
 	}
 }
 
@@ -111,6 +111,9 @@ func (c *Call) Path() string         { return c.P }
 func (c *Call) String() string       { return fmt.Sprintf("%#v", c) }
 func (c *Call) Sys() interface{}     { return c.S }
 func (c *Call) isDir() (bool, error) { return c.Dir, nil }
+func (c *Call) IsDir() bool          { return c.Dir }
+func (c *Call) Root() string         { return "" }
+func (c *Call) Rel() string          { return c.P }
 
 // CallSlice is a convenient wrapper for a slice of Call values, which allows
 // to sort them in ascending order.
@@ -190,14 +193,14 @@ func dummyDoNotWatch(path string) bool {
 func (n *N) Watch(path string, c chan<- EventInfo, events ...Event) {
 	UpdateWait() // we need to wait on Windows because of its asynchronous watcher.
 	path = filepath.Join(n.w.root, path)
-	if err := n.tree.Watch(path, c, dummyDoNotWatch, events...); err != nil {
+	if err := n.tree.Watch(path, c, options{doNotWatch: dummyDoNotWatch}, events...); err != nil {
 		n.t.Errorf("Watch(%s, %p, %v)=%v", path, c, events, err)
 	}
 }
 
 func (n *N) WatchErr(path string, c chan<- EventInfo, err error, events ...Event) {
 	path = filepath.Join(n.w.root, path)
-	switch e := n.tree.Watch(path, c, dummyDoNotWatch, events...); {
+	switch e := n.tree.Watch(path, c, options{doNotWatch: dummyDoNotWatch}, events...); {
 	case err == nil && e == nil:
 		n.t.Errorf("Watch(%s, %p, %v)=nil", path, c, events)
 	case err != nil && e != err:
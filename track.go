@@ -0,0 +1,235 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tracker is a watchpoint, which follows the symlinks found on its path. The
+// parent directories of the symlinks are watched, and each time any of the
+// links is replaced, the real watch is moved to the new target.
+//
+// Both the symlinks and the target are watched on a single proxy channel,
+// as only events sent to the same channel are guaranteed to keep their order.
+type tracker struct {
+	relay
+	t      tree
+	path   string // absolute path of the Watch call, without "..."
+	isrec  bool
+	o      options
+	events Event
+	pc     chan EventInfo // proxy channel of the real watch and the symlinks
+	target string         // canonical form of path
+	links  map[string]struct{}
+	files  map[string]filestate // state of the target files
+	armed  bool                 // whether the real watch is set
+}
+
+func newTracker(t tree, path string, c chan<- EventInfo, o options,
+	events Event) (*tracker, error) {
+	tr := &tracker{
+		t:      t,
+		relay:  relay{c: c},
+		o:      o,
+		events: events,
+		pc:     make(chan EventInfo, buffer),
+	}
+	tr.o.track, tr.o.persistent = false, false
+	if strings.HasSuffix(path, "...") {
+		tr.isrec = true
+		path = path[:len(path)-3]
+	}
+	var err error
+	if tr.path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+	if err = tr.arm(); err != nil {
+		tr.t.Stop(tr.pc)
+		return nil, err
+	}
+	tr.files = tr.digest(nil)
+	// Swapped targets are reported by update rather than scanned again.
+	tr.o.scan = false
+	tr.start(tr.loop)
+	return tr, nil
+}
+
+// arm watches the symlinks on the path and sets the real watch on its target.
+// The symlinks are watched even if the target could not be resolved, so the
+// watch is set once the links are fixed.
+func (tr *tracker) arm() error {
+	links := make(map[string]struct{})
+	target, err := walklinks(tr.path, func(link string) {
+		links[filepath.Clean(link)] = struct{}{}
+	})
+	for link := range links {
+		if err := tr.t.Watch(filepath.Dir(link), tr.pc, options{},
+			Create|Remove|Rename); err != nil {
+			dbgprintf("tracker(%q) error: %v", link, err)
+		}
+	}
+	tr.links = links
+	if err != nil {
+		return err
+	}
+	path := target
+	if tr.isrec {
+		path = filepath.Join(target, "...")
+	}
+	if err = tr.t.Watch(path, tr.pc, tr.o, tr.events); err != nil {
+		return err
+	}
+	tr.target, tr.armed = target, true
+	return nil
+}
+
+func (tr *tracker) loop() {
+	for {
+		select {
+		case <-tr.quit:
+			return
+		case ei := <-tr.pc:
+			if _, ok := tr.links[ei.Path()]; ok {
+				tr.update()
+			} else {
+				tr.forward(ei)
+			}
+		}
+	}
+}
+
+// update moves the real watch after any of the symlinks was changed, and
+// reports the files, which content differs between the old and new target.
+// Events of the old target, which are still queued, are dropped by forward.
+func (tr *tracker) update() {
+	target := tr.target
+	tr.t.Stop(tr.pc)
+	tr.armed = false
+	if err := tr.arm(); err != nil {
+		dbgprintf("tracker(%q) error: %v", tr.path, err)
+		return
+	}
+	if tr.target == target {
+		return
+	}
+	files := tr.digest(tr.files)
+	for rel, st := range files {
+		switch old, ok := tr.files[rel]; {
+		case !ok:
+			tr.swapped(rel, Create)
+		case old.size != st.size || !bytes.Equal(old.sum, st.sum):
+			tr.swapped(rel, Write)
+		}
+	}
+	for rel := range tr.files {
+		if _, ok := files[rel]; !ok {
+			tr.swapped(rel, Remove)
+		}
+	}
+	tr.files = files
+}
+
+// swapped reports the file given by rel as changed in the new target.
+func (tr *tracker) swapped(rel string, e Event) {
+	if tr.events&e == 0 {
+		return
+	}
+	path := filepath.Join(tr.target, rel)
+	tr.send(newMatched(newSynthetic(path, e, false), tr.target).export())
+}
+
+// filestate describes a file of the target. The content digest is needed, as
+// the old target is usually removed right after the swap, before its files
+// could be compared with the new ones.
+type filestate struct {
+	size  int64
+	mtime time.Time
+	ino   uint64
+	sum   []byte
+}
+
+// unchanged reports whether the file was not modified nor replaced since old
+// was taken, as far as its size, modification time and inode tell.
+func (st filestate) unchanged(old filestate) bool {
+	return st.ino != 0 && st.ino == old.ino && st.size == old.size && st.mtime.Equal(old.mtime)
+}
+
+// digest gives the state of the files of the target, by their paths relative
+// to the target. Subdirectories are descended into only for recursive
+// watchpoints. Files, which are unchanged since prev was taken, keep their
+// digests, only the other ones are read.
+func (tr *tracker) digest(prev map[string]filestate) map[string]filestate {
+	files := make(map[string]filestate)
+	if !tr.armed {
+		return files
+	}
+	fn := func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return nil
+		case d.IsDir():
+			if p != tr.target && !tr.isrec {
+				return filepath.SkipDir
+			}
+			return nil
+		case p != tr.target && tr.o.doNotWatch != nil && tr.o.doNotWatch(p):
+			return nil
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil
+		}
+		r := rel(tr.target, p)
+		st := filestate{size: fi.Size(), mtime: fi.ModTime()}
+		st.ino, _ = inode(fi)
+		if old, ok := prev[r]; ok && st.unchanged(old) {
+			st.sum = old.sum
+		} else if st.sum, err = filesum(p); err != nil {
+			return nil
+		}
+		files[r] = st
+		return nil
+	}
+	filepath.WalkDir(tr.target, fn)
+	return files
+}
+
+func filesum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// forward sends the event of the real watch, unless it was reported for
+// the old target, which has been already replaced, or it comes from the
+// watches of the symlinks.
+func (tr *tracker) forward(ei EventInfo) {
+	switch {
+	case !tr.armed || ei.Event()&(tr.events|watchLost|Synced) == 0:
+	case ei.Path() == tr.target || strings.HasPrefix(ei.Path(), tr.target+sep):
+		tr.send(ei)
+	}
+}
+
+// Stop implements proxy interface.
+func (tr *tracker) Stop() {
+	tr.stop()
+	tr.t.Stop(tr.pc)
+}
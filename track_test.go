@@ -0,0 +1,106 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+//go:build darwin || linux || freebsd || dragonfly || netbsd || openbsd || solaris
+// +build darwin linux freebsd dragonfly netbsd openbsd solaris
+
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// swapdata mimics the kubelet updating a ConfigMap volume mounted in dir.
+func swapdata(t *testing.T, dir, name string, files map[string]string) {
+	t.Helper()
+	mustT(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	for file, content := range files {
+		mustT(t, os.WriteFile(filepath.Join(dir, name, file), []byte(content), 0644))
+	}
+	old, _ := os.Readlink(filepath.Join(dir, "..data"))
+	mustT(t, os.Symlink(name, filepath.Join(dir, "..data_tmp")))
+	mustT(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	if old != "" {
+		mustT(t, os.RemoveAll(filepath.Join(dir, old)))
+	}
+}
+
+func TestWatchTrackSymlinks(t *testing.T) {
+	n, dir := newProxyTest(t)
+	swapdata(t, dir, "..2024_01", map[string]string{"key": "a", "other": "a"})
+	for _, file := range []string{"key", "other"} {
+		mustT(t, os.Symlink(filepath.Join("..data", file), filepath.Join(dir, file)))
+	}
+
+	c := watchProxy(t, n, filepath.Join(dir, "key"), []Option{WithTrackSymlinks()}, Write|Remove)
+
+	swapdata(t, dir, "..2024_02", map[string]string{"key": "b", "other": "b"})
+	key := filepath.Join(dir, "..2024_02", "key")
+	if ev := waitEvent(t, c, Write); ev.Path() != key {
+		t.Fatalf("want Write on %s; got %v", key, ev)
+	}
+	// The content did not change.
+	swapdata(t, dir, "..2024_03", map[string]string{"key": "b", "other": "c"})
+	select {
+	case ev := <-c:
+		t.Fatalf("want no event; got %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The watch was moved to the new target.
+	key = filepath.Join(dir, "..2024_03", "key")
+	mustT(t, os.WriteFile(key, []byte("d"), 0644))
+	if ev := waitEvent(t, c, Write); ev.Path() != key {
+		t.Fatalf("want Write on %s; got %v", key, ev)
+	}
+}
+
+func TestWatchTrackSymlinksDir(t *testing.T) {
+	n, dir := newProxyTest(t)
+	swapdata(t, dir, "..2024_01", map[string]string{"a": "a", "b": "b"})
+
+	c := watchProxy(t, n, filepath.Join(dir, "..data"), []Option{WithTrackSymlinks()}, Create|Write|Remove)
+
+	swapdata(t, dir, "..2024_02", map[string]string{"a": "x", "c": "c"})
+	want := map[string]Event{
+		filepath.Join(dir, "..2024_02", "a"): Write,
+		filepath.Join(dir, "..2024_02", "b"): Remove,
+		filepath.Join(dir, "..2024_02", "c"): Create,
+	}
+	timeout := time.After(time.Second)
+	for len(want) != 0 {
+		select {
+		case ev := <-c:
+			if e, ok := want[ev.Path()]; ok && e == ev.Event() {
+				delete(want, ev.Path())
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+func TestTrackerDigest(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	mustT(t, os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644))
+	mustT(t, os.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0644))
+	tr := &tracker{target: dir, armed: true}
+	prev := tr.digest(nil)
+	// Unchanged files keep their digests instead of being read again.
+	fake := []byte("fake")
+	a := prev["a"]
+	a.sum = fake
+	prev["a"] = a
+	mustT(t, os.WriteFile(filepath.Join(dir, "b"), []byte("bb"), 0644))
+	files := tr.digest(prev)
+	if sum := files["a"].sum; string(sum) != string(fake) {
+		t.Errorf("want digest of unchanged a to be kept; got %x", sum)
+	}
+	if sum := files["b"].sum; string(sum) == string(prev["b"].sum) {
+		t.Errorf("want digest of modified b to be taken again")
+	}
+}
@@ -10,115 +10,424 @@ package notify
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
 const buffer = 128
 
 type tree interface {
 	Exclude(string) error
-	Watch(string, chan<- EventInfo, DoNotWatchFn, ...Event) error
+	Watch(string, chan<- EventInfo, options, ...Event) error
 	Stop(chan<- EventInfo)
+	Stats() Stats
 	Close() error
 }
 
 func NewTree() tree {
+	return newTree(config{})
+}
+
+// newTree works like NewTree, but with the settings of a Notify instance.
+func newTree(cfg config) tree {
 	c := make(chan EventInfo, buffer)
 	w := newWatcher(c)
-	return newNonrecursiveTree(w, c, make(chan EventInfo, buffer))
+	return newNonrecursiveTree(w, c, make(chan EventInfo, buffer), cfg)
 }
 
 // internalTree TODO(rjeczalik)
 type internalTree struct {
 	rw     sync.RWMutex // protects root
 	root   root
+	subs   subscriptions
+	depth  depths
+	stats  *statCache
 	w      watcher
 	c      chan EventInfo
 	rec    chan EventInfo
+	queue  *recQueue            // events pending to be sent to rec
+	retry  chan EventInfo       // watchpoint key of parents of skipped directories
+	skip   map[string]*degraded // directories skipped by AddDir
+	kick   chan struct{}        // wakes up retry after skip was changed
+	seen   *seenSet             // entries reported by scan, awaiting their Create
+	shared *sharedWatchpoints   // internal watchpoints shared by nodes
+	hold   holders              // nodes holding the watchpoints of user channels
+	d      *dispatcher
+	snd    *sender  // reused by deliver
+	send   sendFunc // snd.Send
+	hits   []hit    // reused by deliver
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 }
 
 // newNonrecursiveTree TODO(rjeczalik)
-func newNonrecursiveTree(w watcher, c, rec chan EventInfo) *internalTree {
+func newNonrecursiveTree(w watcher, c, rec chan EventInfo, cfg config) *internalTree {
 	ctx, cancel := context.WithCancel(context.Background())
 	if rec == nil {
 		rec = make(chan EventInfo, buffer)
 	}
 	t := &internalTree{
 		root:   root{nd: newnode("")},
+		subs:   make(subscriptions),
+		depth:  make(depths),
+		stats:  newStatCache(),
 		w:      w,
 		c:      c,
 		rec:    rec,
+		queue:  newRecQueue(recQueueMax),
+		retry:  make(chan EventInfo),
+		skip:   make(map[string]*degraded),
+		kick:   make(chan struct{}, 1),
+		seen:   newSeenSet(),
+		shared: newSharedWatchpoints(rec),
+		hold:   make(holders),
+		d:      newDispatcher(ctx, cfg.workers, cfg.queue),
 		ctx:    ctx,
 		cancel: cancel,
 		wg:     sync.WaitGroup{},
 	}
+	t.snd = t.subs.Sender(t.d.Send)
+	t.send = t.snd.Send
 	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
 		t.dispatch(c)
 	}()
 	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.pump()
+	}()
+	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
 		go t.internal(rec)
 	}()
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.retryLoop()
+	}()
 	return t
 }
 
-// dispatch TODO(rjeczalik)
+// dispatch reads events in batches and looks up watchpoints interested in
+// them. Looking up is done in a single goroutine and the matched events are
+// handed over to the dispatcher while still holding the read lock, so each
+// user channel receives events in the order they were reported by the watcher.
 func (t *internalTree) dispatch(c <-chan EventInfo) {
+	buf := make([]EventInfo, 0, dispatchBatch)
 	for {
-		select {
-		case <-t.ctx.Done():
+		events, ok := batch(t.ctx, c, buf)
+		if !ok {
 			return
-		case ei, ok := <-c:
-			if !ok {
+		}
+		t.dispatchBatch(events)
+	}
+}
+
+// dispatchBatch looks up the events under a single read lock, which is
+// released only for events, which need the tree to be changed. Events of
+// directories created or removed within recursive watchpoints are queued for
+// the internal goroutine, so looking up never waits for it.
+func (t *internalTree) dispatchBatch(events []EventInfo) {
+	var fired []chan<- EventInfo
+	var dropped []string // directories, which did not fit into t.queue
+	locked := false
+	lock := func() {
+		if !locked {
+			t.rw.RLock()
+			locked = true
+		}
+	}
+	unlock := func() {
+		if locked {
+			t.rw.RUnlock()
+			locked = false
+		}
+	}
+	for _, ei := range events {
+		if dbgenabled {
+			dbgprintf("dispatching %v on %q", ei.Event(), ei.Path())
+		}
+		if ei.Event()&watchLost != 0 {
+			unlock()
+			fired = append(fired, t.dispatchLost(ei)...)
+			continue
+		}
+		if t.seen.Scanned(ei) {
+			// The entry was already reported and added by scan.
+			release(ei)
+			continue
+		}
+		lock()
+		isrec, f := t.deliver(ei)
+		fired = append(fired, f...)
+		queued := false
+		if t.forward(ei, isrec) {
+			var full bool
+			if queued, full = t.queue.Push(ei); full && t.overflow(ei) {
+				dropped = append(dropped, ei.Path())
+			}
+		}
+		if !queued && t.snd.sent == 0 {
+			// Nothing refers to the event any longer.
+			release(ei)
+		}
+	}
+	unlock()
+	if len(dropped) != 0 {
+		t.rw.Lock()
+		for _, name := range dropped {
+			if _, ok := t.skip[name]; !ok {
+				t.skipDir(name, errRecQueueFull)
+			}
+		}
+		t.rw.Unlock()
+	}
+	for _, c := range fired {
+		t.Stop(c)
+	}
+}
+
+// forward reports whether the internal goroutine is to be told about ei, as
+// it changed a directory within recursive watchpoints, which isrec tells.
+func (t *internalTree) forward(ei EventInfo, isrec bool) bool {
+	switch {
+	case ei.Event() == Attrib && t.skip[ei.Path()] != nil:
+		// Permissions of a skipped directory may have changed, so
+		// adding it is retried.
+		return true
+	// If the event describes newly leaf directory created within
+	case !isrec || ei.Event()&(Create|Remove) == 0:
+		return false
+	default:
+		ok, err := ei.(isDirer).isDir()
+		return ok && err == nil
+	}
+}
+
+// overflow reports whether the directory created, as reported by ei, is to
+// be skipped, as the queue of the internal goroutine is full. Skipped
+// directories are retried like the ones, which failed to be watched, thus
+// they are listed by Stats in the meantime, and WatchFailed is sent if they
+// keep failing. Other events are dropped, the watches of removed directories
+// are cleaned up by dispatchLost, while skipped directories are retried
+// anyway.
+func (t *internalTree) overflow(ei EventInfo) bool {
+	dbgprintf("dropped %v on %q: internal queue is full", ei.Event(), ei.Path())
+	return ei.Event() == Create
+}
+
+// pump sends the events queued by dispatch to the internal goroutine.
+func (t *internalTree) pump() {
+	for {
+		ei, ok := t.queue.Pop()
+		if !ok {
+			select {
+			case <-t.queue.ready:
+				continue
+			case <-t.ctx.Done():
 				return
 			}
-			dbgprintf("dispatching %v on %q", ei.Event(), ei.Path())
-			go func(ei EventInfo) {
-				var nd node
-				var isrec bool
-				dir, base := split(ei.Path())
-				fn := func(it node, isbase bool) error {
-					isrec = isrec || it.Watch.IsRecursive()
-					if isbase {
-						nd = it
-					} else {
-						it.Watch.Dispatch(ei, recursive)
-					}
-					return nil
-				}
-				t.rw.RLock()
-				// Notify recursive watchpoints found on the path.
-				if err := t.root.WalkPath(dir, fn); err != nil {
-					dbgprint("dispatch did not reach leaf:", err)
-					t.rw.RUnlock()
-					return
-				}
-				// Notify parent watchpoint.
-				nd.Watch.Dispatch(ei, 0)
-				isrec = isrec || nd.Watch.IsRecursive()
-				// If leaf watchpoint exists, notify it.
-				if nd, ok := nd.Child[base]; ok {
-					isrec = isrec || nd.Watch.IsRecursive()
-					nd.Watch.Dispatch(ei, 0)
-				}
-				t.rw.RUnlock()
-				// If the event describes newly leaf directory created within
-				if !isrec || ei.Event()&(Create|Remove) == 0 {
-					return
-				}
-				if ok, err := ei.(isDirer).isDir(); !ok || err != nil {
-					return
-				}
-				t.rec <- ei
-			}(ei)
 		}
+		select {
+		case t.rec <- ei:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// recQueueMax is the number of events, above which recQueue drops further
+// ones. Like ringMax, it is a few times the default limit of events queued by
+// the kernel, so it is reached only if the internal goroutine falls behind
+// badly.
+const recQueueMax = 1 << 16
+
+// errRecQueueFull is the error of directories, which were created while the
+// internal goroutine was too far behind to add them, see overflow.
+var errRecQueueFull = errors.New("notify: too many directories pending to be watched")
+
+// recQueue holds the events, which dispatch hands over to the internal
+// goroutine, so looking up further events never waits for directories to be
+// added. It holds only events of directories created or removed within
+// recursive watchpoints, thus it does not grow with events of files. Events,
+// which repeat the latest pending event of the same path, are coalesced.
+type recQueue struct {
+	mu      sync.Mutex
+	q       []EventInfo
+	pending map[string]recPending // by paths of the queued events
+	max     int
+	ready   chan struct{} // signaled after an event was pushed
+}
+
+// recPending describes the queued events of a single path.
+type recPending struct {
+	n    int   // number of the events
+	last Event // the latest of them
+}
+
+func newRecQueue(max int) *recQueue {
+	return &recQueue{
+		pending: make(map[string]recPending),
+		max:     max,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues ei, unless it repeats the latest pending event of its path or
+// the queue is full, as reported by full. It reports whether ei was queued.
+func (q *recQueue) Push(ei EventInfo) (queued, full bool) {
+	q.mu.Lock()
+	p, ok := q.pending[ei.Path()]
+	switch {
+	case ok && p.last == ei.Event():
+		q.mu.Unlock()
+		return false, false
+	case len(q.q) >= q.max:
+		q.mu.Unlock()
+		return false, true
+	}
+	q.q = append(q.q, ei)
+	q.pending[ei.Path()] = recPending{n: p.n + 1, last: ei.Event()}
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true, false
+}
+
+// Pop dequeues the oldest event. It reports false if there is none.
+func (q *recQueue) Pop() (EventInfo, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.q) == 0 {
+		return nil, false
+	}
+	ei := q.q[0]
+	if q.q = q.q[1:]; len(q.q) == 0 {
+		q.q = nil
+	}
+	switch p := q.pending[ei.Path()]; {
+	case p.n > 1:
+		p.n--
+		q.pending[ei.Path()] = p
+	default:
+		delete(q.pending, ei.Path())
+	}
+	return ei, true
+}
+
+// Len gives the number of events pending.
+func (q *recQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.q)
+}
+
+// hit is a watchpoint found on the path of a dispatched event.
+type hit struct {
+	nd    node
+	extra Event
+}
+
+// deliver sends ei to every matching watchpoint, with the tree lock held. It
+// reports whether any recursive watchpoint was found on the event's path and
+// gives oneshot channels, which received the event and are to be stopped. The
+// channels are valid until the next call, t.snd.sent gives the number of
+// channels the event was sent to.
+//
+// It is called by a single goroutine at a time, either the dispatching one
+// or the one holding the tree lock for writing, so it reuses t.snd and t.hits.
+func (t *internalTree) deliver(ei EventInfo) (isrec bool, fired []chan<- EventInfo) {
+	var nd node
+	hits := t.hits[:0]
+	t.snd.Reset()
+	dir, base := split(ei.Path())
+	fn := func(it node, isbase bool) error {
+		isrec = isrec || it.Watch.IsRecursive()
+		if isbase {
+			nd = it
+		} else {
+			hits = append(hits, hit{it, recursive})
+		}
+		return nil
+	}
+	// Look for recursive watchpoints found on the path.
+	if err := t.root.WalkPath(dir, fn); err != nil {
+		if dbgenabled {
+			dbgprint("dispatch did not reach leaf:", err)
+		}
+		return false, nil
+	}
+	// Parent watchpoint.
+	hits = append(hits, hit{nd, 0})
+	isrec = isrec || nd.Watch.IsRecursive()
+	// If leaf watchpoint exists, notify it as well.
+	if nd, ok := nd.Child[base]; ok {
+		isrec = isrec || nd.Watch.IsRecursive()
+		hits = append(hits, hit{nd, 0})
+	}
+	var total Event
+	for _, h := range hits {
+		total |= h.nd.Watch.Total()
+	}
+	if total&Attrib != 0 {
+		ei = t.stats.Update(ei)
+	}
+	for _, h := range hits {
+		send := t.send
+		if h.extra&recursive != 0 {
+			send = t.depth.Filter(h.nd.Name, dir, send)
+		}
+		h.nd.Watch.Dispatch(ei, h.extra, h.nd.Name, send)
+	}
+	t.hits = hits
+	return isrec, t.snd.fired
+}
+
+// dispatchLost removes watchpoints set on the path of ei, which the watcher
+// stopped watching on its own, and sends ei to each channel, which lost its
+// watchpoint. It gives oneshot channels, which are to be stopped.
+func (t *internalTree) dispatchLost(ei EventInfo) []chan<- EventInfo {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	nd, err := t.root.Get(ei.Path())
+	if err != nil {
+		return nil
+	}
+	m := newMatched(ei, nd.Name)
+	snd := t.subs.Sender(t.d.Send)
+	var lost []chan<- EventInfo
+	for c := range nd.Watch {
+		if c != nil && c != t.rec {
+			snd.Send(c, m)
+			lost = append(lost, c)
+		}
+		delete(nd.watch(), c)
 	}
+	if len(nd.Child) == 0 {
+		t.root.Del(nd.Name)
+	}
+	for _, c := range lost {
+		t.depth.Unset(nd.Name, c)
+		t.subs.Unalias(c, nd.Name)
+		if !t.hold.Forget(c, nd.Name, t.holds(c)) {
+			// The channel has no watchpoint left, forget it as Stop does.
+			t.subs.Del(c)
+			t.depth.Del(c)
+		}
+	}
+	t.stats.Prune(func(path string) bool { return wantsAttrib(t.root, path) })
+	return snd.fired
 }
 
 // internal TODO(rjeczalik)
@@ -131,6 +440,10 @@ func (t *internalTree) internal(rec <-chan EventInfo) {
 			if !ok {
 				return
 			}
+			var dt *dirtree
+			if ei.Event() != Remove {
+				dt = t.fetch(ei.Path())
+			}
 			t.rw.Lock()
 			if ei.Event() == Remove {
 				nd, err := t.root.Get(ei.Path())
@@ -138,65 +451,370 @@ func (t *internalTree) internal(rec <-chan EventInfo) {
 					t.rw.Unlock()
 					continue
 				}
-				t.walkWatchpoint(nd, func(_ Event, nd node) error {
+				t.walkWatchpoint(nd, 0, func(_ Event, nd node) error {
 					t.w.Unwatch(nd.Name, false)
 					return nil
 				})
 				t.root.Del(ei.Path())
+				for name := range t.skip {
+					if name == ei.Path() || indexrel(ei.Path(), name) != -1 {
+						t.unskip(name)
+					}
+				}
 				t.rw.Unlock()
 				continue
 			}
-			var nd node
-			var eset = internal
-			t.root.WalkPath(ei.Path(), func(it node, _ bool) error {
-				if e := it.Watch[t.rec]; e != 0 && e > eset {
-					eset = e
-				}
-				nd = it
-				return nil
-			})
-			if eset == internal {
-				t.rw.Unlock()
+			fired, prime := t.add(ei.Path(), dt)
+			t.rw.Unlock()
+			if prime {
+				t.stats.Prime(ei.Path(), true, nil)
+			}
+			for _, c := range fired {
+				t.Stop(c)
+			}
+		}
+	}
+}
+
+// add watches the directory, which was created within, or skipped by,
+// recursive watchpoints, together with its subtree. Directories, which
+// failed to be watched, are recorded for retrying. It gives oneshot channels,
+// which are to be stopped, and reports whether the state of the subtree is to
+// be cached with Prime, once the lock is released.
+//
+// The subtree is taken from the snapshot dt, read off the lock by fetch, so
+// only the directories, which changed since, are read under the lock. If dt
+// is nil, the subtree is read under the lock.
+func (t *internalTree) add(name string, dt *dirtree) ([]chan<- EventInfo, bool) {
+	var nd node
+	var eset = internal
+	t.root.WalkPath(name, func(it node, _ bool) error {
+		if e := it.Watch[t.rec]; e != 0 && e > eset {
+			eset = e
+		}
+		nd = it
+		return nil
+	})
+	depth, ok := t.depthAt(name)
+	if eset == internal || !ok {
+		if _, ok := t.skip[name]; ok {
+			t.unskip(name)
+		}
+		return nil, false
+	}
+	if name != nd.Name {
+		nd = nd.Add(name)
+	}
+	old := t.skip[name]
+	delete(t.skip, name)
+	var err error
+	if dt != nil && dt.root.Name == name {
+		err = nd.AddTree(dt, t.recFunc(eset), nil, depth, t.skipDir, nil)
+	} else {
+		err = nd.AddDir(t.recFunc(eset), nil, depth, t.skipDir)
+	}
+	if err != nil {
+		t.skipDir(name, err)
+	}
+	var fired []chan<- EventInfo
+	switch d, failed := t.skip[name]; {
+	case failed && old != nil:
+		d.Attempts, d.reported = old.Attempts+1, old.reported
+		d.Next = time.Now().Add(backoff(d.Attempts))
+		if d.Attempts >= retryReport && !d.reported {
+			d.reported = true
+			fired = t.fail(name, d.Err)
+		}
+	case old != nil:
+		t.unskip(name)
+	}
+	return append(fired, t.scan(name, dt)...), eset&Attrib != 0
+}
+
+// fetch reads the subtree of the directory, which is to be added, off the
+// lock. The entries of the directories are kept for scan.
+func (t *internalTree) fetch(name string) *dirtree {
+	t.rw.RLock()
+	depth, ok := t.depthAt(name)
+	t.rw.RUnlock()
+	if !ok {
+		return nil
+	}
+	return readtree(name, depth, nil, nil, true)
+}
+
+// scan reports Create events for the entries of the directory, which has just
+// been watched, and of its watched subdirectories. The entries may have been
+// created before the watches were set, in which case no events would be sent
+// for them. The reported entries are recorded, so their real Create events,
+// if any arrive later, are dropped by seenSet.Scanned.
+//
+// Watches of the directories are already set, so no entry goes unnoticed:
+// the entries are taken from the snapshot dt only for the directories, which
+// did not change since it was taken, the others are read again. As the lock
+// is held, the real events of the entries can be dispatched only after scan
+// returns. It gives oneshot channels, which are to be stopped.
+func (t *internalTree) scan(dir string, dt *dirtree) (fired []chan<- EventInfo) {
+	for dirs := []string{dir}; len(dirs) != 0; dirs = dirs[1:] {
+		if nd, err := t.root.Get(dirs[0]); err != nil || nd.Watch[t.rec] == 0 {
+			continue
+		}
+		entries, ok := dt.entries(dirs[0])
+		if !ok {
+			var err error
+			if entries, err = os.ReadDir(dirs[0]); err != nil {
+				dbgprintf("scan(%q) error: %v", dirs[0], err)
 				continue
 			}
-			if ei.Path() != nd.Name {
-				nd = nd.Add(ei.Path())
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dirs[0], entry.Name())
+			if entry.IsDir() {
+				dirs = append(dirs, path)
 			}
-			err := nd.AddDir(t.recFunc(eset), nil)
-			t.rw.Unlock()
-			if err != nil {
-				dbgprintf("internal(%p) error: %v", rec, err)
+			if isExcluded(t.w, path) || !t.seen.Add(path) {
+				continue
 			}
+			_, f := t.deliver(newSynthetic(path, Create, entry.IsDir()))
+			fired = append(fired, f...)
 		}
 	}
+	return fired
+}
+
+// Directories, which failed to be watched, are retried with exponential
+// backoff between retryMin and retryMax. Channels watching them are sent
+// WatchFailed after retryReport failed attempts.
+const (
+	retryMin    = 100 * time.Millisecond
+	retryMax    = time.Minute
+	retryReport = 3
+)
+
+// degraded is a directory skipped by AddDir, which is being retried.
+type degraded struct {
+	Degraded
+	reported bool // whether WatchFailed was sent
+}
+
+// backoff gives the delay of the next attempt after the given number of
+// failed ones.
+func backoff(attempts int) time.Duration {
+	d := retryMin
+	for i := 1; i < attempts && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		return retryMax
+	}
+	return d
+}
+
+// skipDir records a directory, which AddDir failed to add, so adding it is
+// retried with backoff. Unless it has vanished, its parent is also watched
+// for metadata changes, so adding it is retried as soon as its permissions
+// change.
+func (t *internalTree) skipDir(name string, err error) {
+	dbgprintf("skipping %q: %v", name, err)
+	if os.IsNotExist(err) {
+		return
+	}
+	dir, _ := split(name)
+	nd, e := t.root.Get(dir)
+	if e != nil {
+		return
+	}
+	t.skip[name] = &degraded{Degraded: Degraded{
+		Path:     name,
+		Err:      err,
+		Attempts: 1,
+		Next:     time.Now().Add(retryMin),
+	}}
+	select {
+	case t.kick <- struct{}{}:
+	default:
+	}
+	switch diff := nd.watch().Add(t.retry, Attrib|omit); {
+	case diff == none:
+	case diff[0] == 0:
+		e = t.w.Watch(nd.Name, diff[1], false)
+	default:
+		e = t.w.Rewatch(nd.Name, nd.Name, diff[0], diff[1], false)
+	}
+	if e != nil {
+		dbgprintf("skipDir(%q) error: %v", name, e)
+	}
+}
+
+// unskip forgets a skipped directory. If its parent has no more skipped
+// directories, it is no longer watched for their metadata changes.
+func (t *internalTree) unskip(name string) {
+	delete(t.skip, name)
+	dir, _ := split(name)
+	for name := range t.skip {
+		if d, _ := split(name); d == dir {
+			return
+		}
+	}
+	nd, err := t.root.Get(dir)
+	if err != nil {
+		return
+	}
+	if _, ok := nd.Watch[t.retry]; !ok {
+		return
+	}
+	switch diff := nd.watch().Del(t.retry, all); {
+	case diff == none:
+	case diff[1] == 0:
+		t.w.Unwatch(nd.Name, false)
+	default:
+		t.w.Rewatch(nd.Name, nd.Name, diff[0], diff[1], false)
+	}
+}
+
+// fail sends WatchFailed for the directory to the channels of recursive
+// watchpoints, which cover it. It gives oneshot channels, which are to be
+// stopped.
+func (t *internalTree) fail(name string, err error) []chan<- EventInfo {
+	ei := newSynthetic(name, WatchFailed, true)
+	ei.err = err
+	dir, _ := split(name)
+	snd := t.subs.Sender(t.d.Send)
+	t.root.WalkPath(dir, func(nd node, _ bool) error {
+		send := t.depth.Filter(nd.Name, dir, snd.Send)
+		for c, e := range nd.Watch {
+			if c != nil && c != t.rec && c != t.retry && e&recursive != 0 {
+				send(c, newMatched(ei, nd.Name))
+			}
+		}
+		return nil
+	})
+	return snd.fired
+}
+
+// retryLoop retries adding the skipped directories, as their attempts are
+// due.
+func (t *internalTree) retryLoop() {
+	timer := time.NewTimer(retryMax)
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-t.kick:
+		case <-timer.C:
+			t.retryDue()
+		}
+		t.rw.RLock()
+		next := time.Now().Add(retryMax)
+		for _, d := range t.skip {
+			if d.Next.Before(next) {
+				next = d.Next
+			}
+		}
+		t.rw.RUnlock()
+		timer.Reset(time.Until(next))
+	}
+}
+
+// retryDue retries adding the skipped directories, which attempts are due.
+func (t *internalTree) retryDue() {
+	var fired []chan<- EventInfo
+	var prime []string
+	t.rw.RLock()
+	now := time.Now()
+	var due []string
+	for name, d := range t.skip {
+		if !d.Next.After(now) {
+			due = append(due, name)
+		}
+	}
+	t.rw.RUnlock()
+	dts := make([]*dirtree, len(due))
+	for i, name := range due {
+		dts[i] = t.fetch(name)
+	}
+	t.rw.Lock()
+	for i, name := range due {
+		if _, ok := t.skip[name]; ok {
+			f, ok := t.add(name, dts[i])
+			fired = append(fired, f...)
+			if ok {
+				prime = append(prime, name)
+			}
+		}
+	}
+	t.rw.Unlock()
+	for _, name := range prime {
+		t.stats.Prime(name, true, nil)
+	}
+	for _, c := range fired {
+		t.Stop(c)
+	}
+}
+
+// Stats implements tree interface.
+func (t *internalTree) Stats() Stats {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	var s Stats
+	for _, d := range t.skip {
+		s.Degraded = append(s.Degraded, d.Degraded)
+	}
+	sort.Slice(s.Degraded, func(i, j int) bool {
+		return s.Degraded[i].Path < s.Degraded[j].Path
+	})
+	s.Queue = queueStats(t.w)
+	return s
+}
+
+// covered reports whether the directory is watched by a recursive watchpoint.
+func (t *internalTree) covered(dir string) bool {
+	nd, err := t.root.Get(dir)
+	return err == nil && nd.Watch[t.rec]&^internal != 0
+}
+
+// holds gives a function, which reports whether the node of the path still
+// holds a watchpoint of c.
+func (t *internalTree) holds(c chan<- EventInfo) func(string) bool {
+	return func(path string) bool {
+		nd, err := t.root.Get(path)
+		return err == nil && nd.Watch[c] != 0
+	}
 }
 
 // watchAdd TODO(rjeczalik)
 func (t *internalTree) watchAdd(nd node, c chan<- EventInfo, e Event) eventDiff {
+	t.hold.Add(c, nd.Name)
 	if e&recursive != 0 {
-		diff := nd.Watch.Add(t.rec, e|Create|omit)
-		nd.Watch.Add(c, e)
+		diff := nd.watch().Add(t.rec, e|Create|omit)
+		nd.watch().Add(c, e)
 		return diff
 	}
-	return nd.Watch.Add(c, e)
+	return nd.watch().Add(c, e)
 }
 
 // watchDelMin TODO(rjeczalik)
 func (t *internalTree) watchDelMin(min Event, nd node, c chan<- EventInfo, e Event) eventDiff {
 	old, ok := nd.Watch[t.rec]
+	if nd.shared && nd.Watch[c] == 0 && min&^old == 0 && old&^min&^(internal|Create) == 0 {
+		// The shared internal watchpoint stays the same.
+		return none
+	}
+	defer t.compact(nd)
 	if ok {
-		nd.Watch[t.rec] = min
+		nd.watch()[t.rec] = min
 	}
-	diff := nd.Watch.Del(c, e)
+	diff := nd.watch().Del(c, e)
 	if ok {
 		switch old &^= diff[0] &^ diff[1]; {
 		case old|internal == internal:
-			delete(nd.Watch, t.rec)
+			delete(nd.watch(), t.rec)
 			if set, ok := nd.Watch[nil]; ok && len(nd.Watch) == 1 && set == 0 {
-				delete(nd.Watch, nil)
+				delete(nd.watch(), nil)
 			}
 		default:
-			nd.Watch.Add(t.rec, old|Create)
+			nd.watch().Add(t.rec, old|Create)
 			switch {
 			case diff == none:
 			case diff[1]|Create == diff[0]:
@@ -209,6 +827,17 @@ func (t *internalTree) watchDelMin(min Event, nd node, c chan<- EventInfo, e Eve
 	return diff
 }
 
+// compact makes nd share its watchpoint, if it carries the internal one only,
+// and drops it if it is empty.
+func (t *internalTree) compact(nd node) {
+	switch e, ok := nd.Watch[t.rec]; {
+	case len(nd.Watch) == 0:
+		nd.unshare()
+	case ok && !nd.shared && len(nd.Watch) == 2 && nd.Watch[nil] == e&^omit:
+		nd.share(t.shared.Get(e))
+	}
+}
+
 // watchDel TODO(rjeczalik)
 func (t *internalTree) watchDel(nd node, c chan<- EventInfo, e Event) eventDiff {
 	return t.watchDelMin(0, nd, c, e)
@@ -220,7 +849,7 @@ func (t *internalTree) Exclude(pattern string) error {
 
 // Watch TODO(rjeczalik)
 func (t *internalTree) Watch(path string, c chan<- EventInfo,
-	doNotWatch DoNotWatchFn, events ...Event) error {
+	o options, events ...Event) error {
 
 	if c == nil {
 		panic("notify: Watch using nil channel")
@@ -229,22 +858,74 @@ func (t *internalTree) Watch(path string, c chan<- EventInfo,
 	if len(events) == 0 {
 		return nil
 	}
-	path, isrec, err := cleanpath(path)
+	var alias string
+	if o.alias {
+		alias = aliaspath(path)
+	}
+	clean := cleanpath
+	if o.flags&dontFollow != 0 {
+		clean = cleanlink
+	}
+	path, isrec, err := clean(path)
 	if err != nil {
 		return err
 	}
-	eset := joinevents(events)
+	eset := joinevents(events) | o.flags
+	var dt *dirtree
+	if isrec {
+		dt = t.prefetch(path, o)
+	}
+	if err := o.progress.err(); err != nil {
+		return err
+	}
+	var fired []chan<- EventInfo
+	var prime, scan bool
+	defer func() {
+		// The state of files is cached, the initial scan is replayed and
+		// oneshot channels are stopped after the lock is released.
+		if prime {
+			t.stats.Prime(path, isrec, o.doNotWatch)
+		}
+		if scan {
+			fired = append(fired, replay(path, isrec, c, o, t.w, &t.rw, t.subs, t.d.Send)...)
+		}
+		for _, c := range fired {
+			t.Stop(c)
+		}
+	}()
 	t.rw.Lock()
 	defer t.rw.Unlock()
 	nd := t.root.Add(path)
+	var skipped []*os.PathError
 	if isrec {
-		return t.watchrec(nd, c, eset|recursive, doNotWatch)
+		t.depth.Set(path, c, o.depth, nd.Watch[c]&recursive != 0)
+		var skip skipFunc
+		if o.bestEffort {
+			skip = func(name string, err error) {
+				skipped = append(skipped, &os.PathError{Op: "watch", Path: name, Err: err})
+				t.skipDir(name, err)
+			}
+		}
+		err = t.watchrec(nd, c, eset|recursive, o.doNotWatch, skip, dt, o.progress)
+	} else {
+		err = t.watch(nd, c, eset)
+	}
+	if err != nil {
+		return err
+	}
+	t.subs.Add(c, o)
+	if alias != "" {
+		t.subs.Alias(c, path, alias)
 	}
-	return t.watch(nd, c, eset)
+	prime, scan = eset&Attrib != 0, o.scan
+	if len(skipped) != 0 {
+		return &AddDirError{Skipped: skipped}
+	}
+	return nil
 }
 
 func (t *internalTree) watch(nd node, c chan<- EventInfo, e Event) (err error) {
-	diff := nd.Watch.Add(c, e)
+	diff := nd.watch().Add(c, e)
 	switch {
 	case diff == none:
 		return nil
@@ -257,15 +938,23 @@ func (t *internalTree) watch(nd node, c chan<- EventInfo, e Event) (err error) {
 		err = t.w.Rewatch(nd.Name, nd.Name, diff[0], diff[1], false)
 	}
 	if err != nil {
-		nd.Watch.Del(c, diff.Event())
+		nd.watch().Del(c, diff.Event())
 		return err
 	}
+	t.hold.Add(c, nd.Name)
 	return nil
 }
 
 func (t *internalTree) recFunc(e Event) walkFunc {
 	return func(nd node) (err error) {
-		switch diff := nd.Watch.Add(t.rec, e|omit|Create); {
+		var diff eventDiff
+		shared := len(nd.Watch) == 0
+		if shared {
+			diff = nd.share(t.shared.Get(e | omit | Create))
+		} else {
+			diff = nd.watch().Add(t.rec, e|omit|Create)
+		}
+		switch {
 		case diff == none:
 		case diff[1] == 0:
 			// TODO(rjeczalik): cleanup this panic after implementation is stable
@@ -275,48 +964,183 @@ func (t *internalTree) recFunc(e Event) walkFunc {
 		default:
 			err = t.w.Rewatch(nd.Name, nd.Name, diff[0], diff[1], false)
 		}
+		if err != nil {
+			// Forget the events, so that adding the node can be retried.
+			if shared {
+				nd.unshare()
+			} else {
+				nd.watch().Del(t.rec, diff.Event())
+			}
+		}
 		return
 	}
 }
 
+// prefetch reads the directory subtree of a recursive Watch call off the
+// lock, unless the path is already watched recursively.
+func (t *internalTree) prefetch(path string, o options) *dirtree {
+	t.rw.RLock()
+	nd, err := t.root.Get(path)
+	watched := err == nil && nd.Watch[t.rec] != 0
+	t.rw.RUnlock()
+	if watched {
+		return nil
+	}
+	depth := -1
+	if o.depth > 0 {
+		depth = o.depth
+	}
+	return readtree(path, depth, o.doNotWatch, o.progress, false)
+}
+
+// yield releases the tree lock for a moment, so that events are dispatched
+// while the subtree of nd is added by WatchAsync. It fails if the setup was
+// cancelled or nd was removed from the tree in the meantime.
+func (t *internalTree) yield(nd node, pr *progress) func() error {
+	return func() error {
+		t.rw.Unlock()
+		runtime.Gosched()
+		t.rw.Lock()
+		if err := pr.err(); err != nil {
+			return err
+		}
+		if cur, err := t.root.Get(nd.Name); err != nil || cur.Watch[t.rec] == 0 {
+			return &os.PathError{Op: "watch", Path: nd.Name, Err: os.ErrNotExist}
+		}
+		return nil
+	}
+}
+
 func (t *internalTree) watchrec(nd node, c chan<- EventInfo, e Event,
-	doNotWatch DoNotWatchFn) error {
+	doNotWatch DoNotWatchFn, skip skipFunc, dt *dirtree, pr *progress) error {
 	var traverse func(walkFunc, DoNotWatchFn) error
 	// Non-recursive tree listens on Create event for every recursive
 	// watchpoint in order to automagically set a watch for every
 	// created directory.
-	switch diff := nd.Watch.dryAdd(t.rec, e|Create); {
-	case diff == none:
+	diff := nd.Watch.dryAdd(t.rec, e|Create)
+	switch {
+	case diff == none && len(t.depth) == 0:
 		t.watchAdd(nd, c, e)
-		nd.Watch.Add(t.rec, e|omit|Create)
+		nd.watch().Add(t.rec, e|omit|Create)
 		return nil
-	case diff[1] == 0:
+	case diff != none && diff[1] == 0:
 		// TODO(rjeczalik): cleanup this panic after implementation is stable
 		panic("eset is empty: " + nd.Name)
-	case diff[0] == 0:
+	case diff[0] == 0 || len(t.depth) != 0:
 		// TODO(rjeczalik): BFS into directories and skip subtree as soon as first
 		// recursive watchpoint is encountered.
-		traverse = nd.AddDir
+		//
+		// With depth limits in place the subtree is walked again, as it may
+		// have been added with a lower limit. The watchpoint of c is not
+		// added yet, so its limit is accounted separately.
+		depth := -1
+		if lim, ok := t.depth[nd.Name][c]; ok {
+			depth = lim
+		}
+		if d, ok := t.depthAt(nd.Name); ok {
+			depth = maxdepth(depth, d)
+		}
+		traverse = func(fn walkFunc, doNotWatch DoNotWatchFn) error {
+			if dt != nil {
+				var yield func() error
+				if pr != nil {
+					yield = t.yield(nd, pr)
+				}
+				return nd.AddTree(dt, fn, doNotWatch, depth, skip, yield)
+			}
+			return nd.AddDir(fn, doNotWatch, depth, skip)
+		}
 	default:
 		traverse = nd.Walk
 	}
-	// TODO(rjeczalik): account every path that failed to be (re)watched
-	// and retry.
-	if err := traverse(t.recFunc(e), doNotWatch); err != nil {
+	// Paths, which failed to be watched, are skipped and retried only with
+	// best effort, otherwise the Watch call fails.
+	if err := traverse(pr.counting(t.recFunc(e)), doNotWatch); err != nil {
+		t.unwatchrec(nd)
 		return err
 	}
 	t.watchAdd(nd, c, e)
 	return nil
 }
 
+// unwatchrec removes the watches, which a failed recursive Watch call left in
+// the subtree of nd, unless they are needed by other recursive watchpoints.
+func (t *internalTree) unwatchrec(nd node) {
+	type item struct {
+		nd   node
+		need bool // whether a recursive watchpoint is set on the path
+	}
+	hasrec := func(nd node) bool {
+		for c, e := range nd.Watch {
+			if c != nil && c != t.rec && e&recursive != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	var need bool
+	t.root.WalkPath(nd.Name, func(it node, _ bool) error {
+		need = need || hasrec(it)
+		return nil
+	})
+	stack := []item{{nd, need}}
+	for n := len(stack); n != 0; n = len(stack) {
+		it := stack[n-1]
+		stack = stack[:n-1]
+		need := it.need || hasrec(it.nd)
+		if _, ok := it.nd.Watch[t.rec]; ok && !need {
+			switch diff := it.nd.watch().Del(t.rec, all); {
+			case diff == none:
+			case diff[1] == 0:
+				t.w.Unwatch(it.nd.Name, false)
+			default:
+				t.w.Rewatch(it.nd.Name, it.nd.Name, diff[0], diff[1], false)
+			}
+			t.compact(it.nd)
+		}
+		for _, child := range it.nd.Child {
+			stack = append(stack, item{child, need})
+		}
+	}
+}
+
+// depthAt gives the number of directory levels below the path, which are
+// to be watched by the recursive watchpoints found on it, negative meaning
+// no limit. It reports false if the path lies deeper than all the limits.
+func (t *internalTree) depthAt(path string) (depth int, ok bool) {
+	fn := func(it node, _ bool) error {
+		for c, e := range it.Watch {
+			if c == nil || c == t.rec || e&recursive == 0 {
+				continue
+			}
+			lim, limited := t.depth[it.Name][c]
+			switch n := level(it.Name, path); {
+			case !limited:
+				depth, ok = -1, true
+				return errSkip
+			case n <= lim && (!ok || lim-n > depth):
+				depth, ok = lim-n, true
+			}
+		}
+		return nil
+	}
+	if len(t.depth) == 0 {
+		return -1, true
+	}
+	t.root.WalkPath(path, fn)
+	return depth, ok
+}
+
 type walkWatchpointFunc func(Event, node) error
 
-func (t *internalTree) walkWatchpoint(nd node, fn walkWatchpointFunc) error {
+// walkWatchpoint calls fn for every node with watchpoints in the subtree of
+// nd, passing the internal watchpoint of its parent, which is min for nd.
+func (t *internalTree) walkWatchpoint(nd node, min Event, fn walkWatchpointFunc) error {
 	type minode struct {
 		min Event
 		nd  node
 	}
-	mnd := minode{nd: nd}
+	mnd := minode{min: min, nd: nd}
 	stack := []minode{mnd}
 Traverse:
 	for n := len(stack); n != 0; n = len(stack) {
@@ -343,21 +1167,57 @@ Traverse:
 // Stop TODO(rjeczalik)
 func (t *internalTree) Stop(c chan<- EventInfo) {
 	fn := func(min Event, nd node) error {
+		rec := nd.Watch[t.rec]
 		// TODO(rjeczalik): aggregate watcher errors and retry; in worst case
 		// forward to the user.
 		switch diff := t.watchDelMin(min, nd, c, all); {
 		case diff == none:
-			return nil
 		case diff[1] == 0:
 			t.w.Unwatch(nd.Name, false)
 		default:
 			t.w.Rewatch(nd.Name, nd.Name, diff[0], diff[1], false)
 		}
+		if nd.Watch[t.rec] == rec {
+			// The subtree is not affected, unless its nodes hold c as well,
+			// in which case they are visited on their own.
+			return errSkip
+		}
 		return nil
 	}
 	t.rw.Lock()
-	err := t.walkWatchpoint(t.root.nd, fn) // TODO(rjeczalik): store max root per c
+	var err error
+	for _, path := range t.hold.Del(c) {
+		var nd node
+		var min Event
+		e := t.root.WalkPath(path, func(it node, isbase bool) error {
+			if isbase {
+				nd = it
+			} else {
+				min = it.Watch[t.rec]
+			}
+			return nil
+		})
+		if e != nil {
+			// The node was removed in the meantime.
+			continue
+		}
+		err = nonil(err, t.walkWatchpoint(nd, min, fn))
+	}
+	t.subs.Del(c)
+	t.depth.Del(c)
+	for name := range t.skip {
+		// Skipped directories are retried only within recursive watchpoints.
+		if dir, _ := split(name); !t.covered(dir) {
+			t.unskip(name)
+		}
+	}
+	t.seen.Forget(func(name string) bool {
+		dir, _ := split(name)
+		return !t.covered(dir)
+	})
+	t.stats.Prune(func(path string) bool { return wantsAttrib(t.root, path) })
 	t.rw.Unlock()
+	t.d.Flush(c)
 	dbgprintf("Stop(%p) error: %v\n", c, err)
 }
 
@@ -366,7 +1226,8 @@ func (t *internalTree) Close() error {
 	t.cancel()
 	err := t.w.Close()
 	close(t.c)
-	close(t.rec)
 	t.wg.Wait()
+	close(t.rec)
+	t.d.Wait()
 	return err
 }
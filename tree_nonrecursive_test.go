@@ -9,13 +9,22 @@
 package notify
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func NewNonrecursiveTreeTest(t *testing.T, tree string) *N {
 	n := newTreeN(t, tree)
-	n.tree = newNonrecursiveTree(n.spy, n.c, nil)
+	n.tree = newNonrecursiveTree(n.spy, n.c, nil, config{})
 	t.Cleanup(n.Close)
 	return n
 }
@@ -38,8 +47,9 @@ func NewNonrecursiveTreeTestC(t *testing.T, tree string) (*N, chan EventInfo) {
 		}
 	}()
 	n := newTreeN(t, tree)
-	tr := newNonrecursiveTree(n.spy, n.c, recinternal)
+	tr := newNonrecursiveTree(n.spy, n.c, recinternal, config{})
 	tr.rec = rec
+	tr.shared = newSharedWatchpoints(rec)
 	n.tree = tr
 	t.Cleanup(n.Close)
 	return n, recuser
@@ -575,3 +585,447 @@ func TestNonrecursiveTreeInternal(t *testing.T) {
 
 	n.ExpectTreeEvents(events[:], ch)
 }
+
+func TestNonrecursiveTreeOrder(t *testing.T) {
+	n := NewNonrecursiveTreeTest(t, "testdata/vfs.txt")
+
+	ch := NewChans(2)
+
+	n.Watch("src/github.com/rjeczalik/fs", ch[0], Create, Write, Remove)
+	n.Watch("src/github.com/rjeczalik/fs/...", ch[1], Create, Write, Remove)
+
+	events := [...]Event{Create, Write, Write, Remove}
+	want := make([]Call, 0, buffer)
+	for i := 0; len(want) < buffer-len(events); i++ {
+		for _, e := range events {
+			want = append(want, Call{P: fmt.Sprintf("src/github.com/rjeczalik/fs/file%d", i), E: e})
+		}
+	}
+	for i := range want {
+		n.c <- n.abs(want[i])
+	}
+	for _, c := range ch {
+		for i := range want {
+			select {
+			case got := <-c:
+				if err := EqualEventInfo(&want[i], got); err != nil {
+					t.Fatalf("%v (i=%d)", err, i)
+				}
+			case <-time.After(n.timeout()):
+				t.Fatalf("timed out waiting for %v on %s (i=%d)", want[i].E, want[i].P, i)
+			}
+		}
+	}
+}
+
+// flakyWatcher fails to watch the paths, until their failures are used up.
+type flakyWatcher struct {
+	watcher
+	mu    sync.Mutex
+	fails map[string]int
+}
+
+func (w *flakyWatcher) Watch(path string, e Event, isrec bool) error {
+	w.mu.Lock()
+	n := w.fails[path]
+	w.fails[path] = n - 1
+	w.mu.Unlock()
+	if n > 0 {
+		return syscall.ENOSPC
+	}
+	return w.watcher.Watch(path, e, isrec)
+}
+
+func TestNonrecursiveTreeRetry(t *testing.T) {
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	dir := filepath.Join(root, "dir")
+	c := make(chan EventInfo, buffer)
+	w := &flakyWatcher{watcher: newWatcher(c), fails: map[string]int{dir: retryReport}}
+	tr := newNonrecursiveTree(w, c, nil, config{})
+	defer tr.Close()
+
+	ch := make(chan EventInfo, buffer)
+	mustT(t, tr.Watch(filepath.Join(root, "..."), ch, options{}, Create))
+	defer tr.Stop(ch)
+	mustT(t, os.Mkdir(dir, 0755))
+	if ev := waitEvent(t, ch, Create); ev.Path() != dir {
+		t.Fatalf("want Create on %s; got %v", dir, ev)
+	}
+	ev := waitEvent(t, ch, WatchFailed)
+	if ev.Path() != dir || !errors.Is(ev.(Errorer).Err(), syscall.ENOSPC) {
+		t.Fatalf("want WatchFailed on %s with ENOSPC; got %v (err=%v)", dir, ev, ev.(Errorer).Err())
+	}
+	if s := tr.Stats(); len(s.Degraded) != 1 || s.Degraded[0].Path != dir ||
+		s.Degraded[0].Attempts != retryReport {
+		t.Fatalf("want %s degraded after %d attempts; got %+v", dir, retryReport, s)
+	}
+	// The next attempt succeeds.
+	timeout := time.After(5 * backoff(retryReport))
+	for len(tr.Stats().Degraded) != 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("want no degraded directories; got %+v", tr.Stats())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	file := filepath.Join(dir, "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, ch, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+}
+
+// gatedWatcher blocks watching the path, until the gate is opened.
+type gatedWatcher struct {
+	watcher
+	path string
+	gate chan struct{}
+}
+
+func (w *gatedWatcher) Watch(path string, e Event, isrec bool) error {
+	if path == w.path {
+		<-w.gate
+	}
+	return w.watcher.Watch(path, e, isrec)
+}
+
+func TestNonrecursiveTreeWatchAsync(t *testing.T) {
+	root, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	mktree := func(top string) (n int) {
+		for i := 0; i < 20; i++ {
+			for j := 0; j < 20; j++ {
+				mustT(t, os.MkdirAll(filepath.Join(top, fmt.Sprint(i), fmt.Sprint(j)), 0755))
+			}
+		}
+		return 1 + 20 + 20*20
+	}
+	fast, slow := filepath.Join(root, "fast"), filepath.Join(root, "slow")
+	want := mktree(fast)
+	mktree(slow)
+	c := make(chan EventInfo, buffer)
+	w := &gatedWatcher{watcher: newWatcher(c), path: slow, gate: make(chan struct{})}
+	tr := newNonrecursiveTree(w, c, nil, config{})
+	n := &Notify{tree: tr, proxies: newProxies()}
+	defer n.Close()
+
+	wait := func(s *Setup) {
+		t.Helper()
+		select {
+		case <-s.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the setup (walked=%d, watched=%d)",
+				s.Walked(), s.Watched())
+		}
+	}
+	ch := make(chan EventInfo, buffer)
+	s := n.WatchAsync(filepath.Join(fast, "..."), ch, nil, Create)
+	wait(s)
+	mustT(t, s.Err())
+	if s.Walked() != want || s.Watched() != want {
+		t.Fatalf("want %d directories walked and watched; got %d and %d", want,
+			s.Walked(), s.Watched())
+	}
+	file := filepath.Join(fast, "19", "19", "file")
+	mustT(t, os.WriteFile(file, nil, 0644))
+	if ev := waitEvent(t, ch, Create); ev.Path() != file {
+		t.Fatalf("want Create on %s; got %v", file, ev)
+	}
+
+	// Stopping the channel cancels the setup and removes its watches.
+	cancelled := make(chan EventInfo, buffer)
+	s = n.WatchAsync(filepath.Join(slow, "..."), cancelled, nil, Create)
+	for s.Walked() != want {
+		time.Sleep(time.Millisecond)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		n.Stop(cancelled)
+		close(stopped)
+	}()
+	for s.pr.err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	close(w.gate)
+	<-stopped
+	wait(s)
+	if err := s.Err(); err != context.Canceled {
+		t.Fatalf("want %v; got %v", context.Canceled, err)
+	}
+	tr.rw.RLock()
+	defer tr.rw.RUnlock()
+	if nd, err := tr.root.Get(slow); err == nil && len(nd.Watch) != 0 {
+		t.Fatalf("want no watchpoints on %s; got %v", slow, nd.Watch)
+	}
+}
+
+// nopWatcher accepts all the calls without watching anything.
+type nopWatcher struct{}
+
+func (nopWatcher) Exclude(string) error                             { return nil }
+func (nopWatcher) Watch(string, Event, bool) error                  { return nil }
+func (nopWatcher) Unwatch(string, bool) error                       { return nil }
+func (nopWatcher) Rewatch(string, string, Event, Event, bool) error { return nil }
+func (nopWatcher) Close() error                                     { return nil }
+
+// heapInUse gives the number of bytes held by live objects.
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// stormTree gives a tree watching a directory recursively with ch, which
+// does not watch anything and whose internal goroutine never adds directories.
+func stormTree(t *testing.T, ch chan<- EventInfo) (*internalTree, chan EventInfo, string) {
+	t.Helper()
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	c := make(chan EventInfo, buffer)
+	tr := newNonrecursiveTree(nopWatcher{}, c, nil, config{workers: 4, queue: 16})
+	stall := make(chan EventInfo)
+	tr.rec, tr.shared = stall, newSharedWatchpoints(stall)
+	t.Cleanup(func() { tr.Close() })
+	mustT(t, tr.Watch(filepath.Join(dir, "..."), ch, options{}, Create|Remove|Write))
+	return tr, c, dir
+}
+
+// TestNonrecursiveTreeEventStorm checks the number of goroutines and the
+// memory held do not grow with the number of events dispatched.
+func TestNonrecursiveTreeEventStorm(t *testing.T) {
+	const n = 100000
+	ch := make(chan EventInfo, buffer)
+	_, c, dir := stormTree(t, ch)
+	last := filepath.Join(dir, "last")
+	var peak int
+	done := make(chan int)
+	go func() {
+		got := 0
+		for ei := range ch {
+			if ei.Path() == last {
+				break
+			}
+			if got++; got%1000 == 0 {
+				peak = max(peak, runtime.NumGoroutine())
+			}
+		}
+		done <- got
+	}()
+	base, before := runtime.NumGoroutine(), heapInUse()
+	events := [...]Event{Create, Write, Remove}
+	for i := 0; i < n; i++ {
+		c <- newSynthetic(filepath.Join(dir, "file"+strconv.Itoa(i%100)), events[i%3], false)
+	}
+	// Events are dropped if the receiver is too slow, so the last one is sent
+	// until it is received.
+	timeout := time.After(30 * time.Second)
+	for got := -1; got == -1; {
+		c <- newSynthetic(last, Write, false)
+		select {
+		case got = <-done:
+			t.Logf("received %d of %d events", got, n)
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for the events")
+		}
+	}
+	if peak > base {
+		t.Fatalf("want at most %d goroutines; got %d", base, peak)
+	}
+	if held := int64(heapInUse()) - int64(before); held > 1<<20 {
+		t.Fatalf("want at most 1MiB held after %d events; got %d bytes", n, held)
+	}
+}
+
+func TestNonrecursiveTreeEventStormInternalBusy(t *testing.T) {
+	const n = 10 * buffer
+	ch := make(chan EventInfo, n)
+	tr, c, dir := stormTree(t, ch)
+	for i := 0; i < n; i++ {
+		c <- newSynthetic(filepath.Join(dir, strconv.Itoa(i)), Create, true)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the event %d of %d", i, n)
+		}
+	}
+	// The first directory is stuck in the internal goroutine.
+	if got := tr.queue.Len(); got != n-1 {
+		t.Fatalf("want %d directories pending; got %d", n-1, got)
+	}
+}
+
+func TestNonrecursiveTreeQueueOverflow(t *testing.T) {
+	ch := make(chan EventInfo, buffer)
+	tr, c, dir := stormTree(t, ch)
+	for i := 0; ; i++ {
+		ei := newSynthetic(filepath.Join(dir, "fill"+strconv.Itoa(i)), Create, true)
+		if _, full := tr.queue.Push(ei); full {
+			break
+		}
+	}
+	name := filepath.Join(dir, "new")
+	mustT(t, os.Mkdir(name, 0755))
+	c <- newSynthetic(name, Create, true)
+	// The directory is reported as degraded and then retried.
+	degraded := false
+	for retried, timeout := false, time.After(5*time.Second); !retried; {
+		for _, d := range tr.Stats().Degraded {
+			if d.Path == name {
+				if d.Err != errRecQueueFull {
+					t.Fatalf("want err=%v; got %v", errRecQueueFull, d.Err)
+				}
+				degraded = true
+			}
+		}
+		tr.rw.RLock()
+		nd, err := tr.root.Get(name)
+		retried = degraded && tr.skip[name] == nil && err == nil && nd.Watch[tr.rec] != 0
+		tr.rw.RUnlock()
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s to be retried (degraded=%t)", name, degraded)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRecQueue(t *testing.T) {
+	q := newRecQueue(3)
+	cases := [...]struct {
+		ei           EventInfo
+		queued, full bool
+	}{
+		{newSynthetic("/a", Create, true), true, false},
+		{newSynthetic("/a", Create, true), false, false},
+		{newSynthetic("/a", Remove, true), true, false},
+		{newSynthetic("/a", Create, true), true, false},
+		{newSynthetic("/b", Create, true), false, true},
+	}
+	for i, cas := range cases {
+		if queued, full := q.Push(cas.ei); queued != cas.queued || full != cas.full {
+			t.Errorf("want Push()=(%t, %t); got (%t, %t) (i=%d)", cas.queued, cas.full, queued, full, i)
+		}
+	}
+	for i, e := range []Event{Create, Remove, Create} {
+		if ei, ok := q.Pop(); !ok || ei.Event() != e {
+			t.Fatalf("want %v popped; got %v (i=%d)", e, ei, i)
+		}
+	}
+	if _, ok := q.Pop(); ok || len(q.pending) != 0 {
+		t.Fatalf("want empty queue; got len(pending)=%d", len(q.pending))
+	}
+	// Once popped, the event is no longer coalesced.
+	if queued, _ := q.Push(newSynthetic("/a", Create, true)); !queued {
+		t.Error("want Create on /a to be queued")
+	}
+}
+
+// BenchmarkTreeMemory measures the memory held by the tree for a recursive
+// watchpoint set on the given number of directories, 100 per directory, as
+// reported by the B/dir metric.
+func BenchmarkTreeMemory(b *testing.B) {
+	for _, n := range []int{1e5, 1e6} {
+		b.Run("dirs="+strconv.Itoa(n), func(b *testing.B) {
+			rec := make(chan EventInfo)
+			var held uint64
+			for i := 0; i < b.N; i++ {
+				before := heapInUse()
+				t := &internalTree{
+					root:   root{nd: newnode("")},
+					w:      nopWatcher{},
+					rec:    rec,
+					shared: newSharedWatchpoints(rec),
+				}
+				fn := t.recFunc(Create | Remove | Write)
+				queue := []node{t.root.Add("/srv/data")}
+				for added := 0; added < n; queue = queue[1:] {
+					for j := 0; j < 100 && added < n; j++ {
+						name := fmt.Sprintf("d%02d", j)
+						nd := queue[0].addchild(queue[0].Name+"/"+name, name)
+						mustT(b, fn(nd))
+						queue = append(queue, nd)
+						added++
+					}
+				}
+				queue = nil
+				held += heapInUse() - before
+				runtime.KeepAlive(t)
+			}
+			b.ReportMetric(float64(held)/float64(b.N)/float64(n), "B/dir")
+		})
+	}
+}
+
+// BenchmarkStop measures Stop of one of many channels, each of them watching
+// its own subtree of 10 directories recursively.
+func BenchmarkStop(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run("watchpoints="+strconv.Itoa(n), func(b *testing.B) {
+			tr := newNonrecursiveTree(nopWatcher{}, make(chan EventInfo), nil, config{})
+			defer tr.Close()
+			watch := func(c chan<- EventInfo, i int) {
+				tr.rw.Lock()
+				defer tr.rw.Unlock()
+				nd := tr.root.Add(fmt.Sprintf("/srv/data/d%02d/d%03d", i%100, i/100))
+				fn := tr.recFunc(Create | recursive)
+				mustT(b, fn(nd))
+				for j := 0; j < 9; j++ {
+					name := fmt.Sprintf("d%d", j)
+					mustT(b, fn(nd.addchild(nd.Name+"/"+name, name)))
+				}
+				tr.watchAdd(nd, c, Create|recursive)
+			}
+			chans := NewChans(n)
+			for i, c := range chans {
+				watch(c, i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.Stop(chans[i%n])
+				b.StopTimer()
+				watch(chans[i%n], i%n)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkDispatch measures looking up an event in a tree of 1000 directories
+// watched recursively, together with handing it over to a channel, unless it
+// is not watched for. The only allocation is the event sent to the channel,
+// which is owned by the receiver.
+func BenchmarkDispatch(b *testing.B) {
+	for _, e := range []Event{Create, Write} {
+		b.Run(e.String(), func(b *testing.B) {
+			ch := make(chan EventInfo, buffer)
+			go func() {
+				for range ch {
+				}
+			}()
+			defer close(ch)
+			tr := newNonrecursiveTree(nopWatcher{}, make(chan EventInfo), nil, config{})
+			defer tr.Close()
+			tr.rw.Lock()
+			nd := tr.root.Add("/srv/data")
+			fn := tr.recFunc(Create | recursive)
+			mustT(b, fn(nd))
+			for i := 0; i < 1000; i++ {
+				name := fmt.Sprintf("d%03d", i)
+				mustT(b, fn(nd.addchild(nd.Name+"/"+name, name)))
+			}
+			tr.watchAdd(nd, ch, Create|recursive)
+			tr.rw.Unlock()
+			events := []EventInfo{newSynthetic("/srv/data/d500/file", e, false)}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.dispatchBatch(events)
+			}
+		})
+	}
+}
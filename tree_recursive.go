@@ -18,12 +18,20 @@ import (
 
 // internalTree represents a tree structure for managing recursive watchpoints.
 type internalTree struct {
-	rw   sync.RWMutex // protects root
-	root root
+	rw    sync.RWMutex // protects root and subs
+	root  root
+	subs  subscriptions
+	depth depths
+	stats *statCache
 	// TODO(rjeczalik): merge watcher + recursiveWatcher after #5 and #6
 	w      watcher
 	c      chan EventInfo
 	rec    chan EventInfo
+	hold   holders // nodes holding the watchpoints of user channels
+	d      *dispatcher
+	snd    *sender  // reused by deliver
+	send   sendFunc // snd.Send
+	hits   []hit    // reused by deliver
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -33,21 +41,27 @@ const buffer = 128
 
 type tree interface {
 	Exclude(string) error
-	Watch(string, chan<- EventInfo, DoNotWatchFn, ...Event) error
+	Watch(string, chan<- EventInfo, options, ...Event) error
 	Stop(chan<- EventInfo)
+	Stats() Stats
 	Close() error
 }
 
 func NewTree() tree {
+	return newTree(config{})
+}
+
+// newTree works like NewTree, but with the settings of a Notify instance.
+func newTree(cfg config) tree {
 	c := make(chan EventInfo, buffer)
 	w := newWatcher(c)
-	return newRecursiveTree(w, c)
+	return newRecursiveTree(w, c, cfg)
 }
 
 // watchAdd adds a watchpoint to the given node and updates the event difference.
 func watchAdd(nd node, c chan<- EventInfo, newState Event) eventDiff {
-	diff := nd.Watch.Add(c, newState)
-	if wp := nd.Child[""].Watch; len(wp) != 0 {
+	diff := nd.watch().Add(c, newState)
+	if wp := inactive(nd); len(wp) != 0 {
 		currentState := wp.Total()
 		return differ(currentState, currentState, diff)
 	}
@@ -56,15 +70,20 @@ func watchAdd(nd node, c chan<- EventInfo, newState Event) eventDiff {
 
 // watchAddInactive adds an inactive watchpoint to the given node.
 func watchAddInactive(nd node, c chan<- EventInfo, newState Event) eventDiff {
-	wp := nd.Child[""].Watch
-	if wp == nil {
-		wp = make(watchpoint)
-		nd.Child[""] = node{Watch: wp}
-	}
+	wp := nd.addchild("", "").watch()
 	currentState := nd.Watch.Total()
 	return differ(currentState, currentState, wp.Add(c, newState))
 }
 
+// inactive gives the inactive watchpoints of nd, which are held by its child
+// with empty name, or nil if there are none.
+func inactive(nd node) watchpoint {
+	if in, ok := nd.Child[""]; ok {
+		return in.Watch
+	}
+	return nil
+}
+
 func differ(e0, e1 Event, diff eventDiff) eventDiff {
 	diff[0] |= e0
 	diff[1] |= e1
@@ -82,9 +101,9 @@ func watchCopy(src, dst node) {
 		}
 		watchAddInactive(dst, c, e)
 	}
-	if wpsrc := src.Child[""].Watch; len(wpsrc) != 0 {
+	if wpsrc := inactive(src); len(wpsrc) != 0 {
 		// Copy child watchpoints.
-		wpdst := dst.Child[""].Watch
+		wpdst := dst.addchild("", "").watch()
 		for c, e := range wpsrc {
 			if c == nil {
 				continue
@@ -96,8 +115,8 @@ func watchCopy(src, dst node) {
 
 // watchDel removes a watchpoint from the given node and updates the event difference.
 func watchDel(nd node, c chan<- EventInfo, newState Event) eventDiff {
-	diff := nd.Watch.Del(c, newState)
-	if wp := nd.Child[""].Watch; len(wp) != 0 {
+	diff := nd.watch().Del(c, newState)
+	if wp := inactive(nd); len(wp) != 0 {
 		diffInactive := wp.Del(c, newState)
 		e := wp.Total()
 		// TODO(rjeczalik): add e if e != all?
@@ -109,7 +128,7 @@ func watchDel(nd node, c chan<- EventInfo, newState Event) eventDiff {
 // watchTotal calculates the total events for the given node.
 func watchTotal(nd node) Event {
 	e := nd.Watch.Total()
-	if wp := nd.Child[""].Watch; len(wp) != 0 {
+	if wp := inactive(nd); len(wp) != 0 {
 		// Include child watchpoints in the total.
 		e |= wp.Total()
 	}
@@ -122,23 +141,30 @@ func watchIsRecursive(nd node) bool {
 	// If a watchpoint holds inactive watchpoints, it means it's a parent
 	// one, which is recursive by nature even though it may be not recursive
 	// itself.
-	if wp := nd.Child[""].Watch; len(wp) != 0 {
+	if wp := inactive(nd); len(wp) != 0 {
 		return true
 	}
 	return nd.Watch.IsRecursive()
 }
 
 // newRecursiveTree initializes a new internalTree instance.
-func newRecursiveTree(w watcher, c chan EventInfo) *internalTree {
+func newRecursiveTree(w watcher, c chan EventInfo, cfg config) *internalTree {
 	ctx, cancel := context.WithCancel(context.Background())
 	t := &internalTree{
 		root:   root{nd: newnode("")},
+		subs:   make(subscriptions),
+		depth:  make(depths),
+		stats:  newStatCache(),
 		w:      w,
 		c:      c,
+		hold:   make(holders),
+		d:      newDispatcher(ctx, cfg.workers, cfg.queue),
 		ctx:    ctx,
 		cancel: cancel,
 		wg:     sync.WaitGroup{},
 	}
+	t.snd = t.subs.Sender(t.d.Send)
+	t.send = t.snd.Send
 	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
@@ -147,44 +173,94 @@ func newRecursiveTree(w watcher, c chan EventInfo) *internalTree {
 	return t
 }
 
-// dispatch handles the dispatching of events to watchpoints.
+// dispatch handles the dispatching of events to watchpoints. Events are
+// looked up in batches in a single goroutine and handed over to the
+// dispatcher while holding the read lock, so each user channel receives them
+// in order.
 func (t *internalTree) dispatch() {
+	buf := make([]EventInfo, 0, dispatchBatch)
 	for {
-		select {
-		case <-t.ctx.Done():
+		events, ok := batch(t.ctx, t.c, buf)
+		if !ok {
 			return
-		case ei, ok := <-t.c:
-			if !ok {
-				return
-			}
+		}
+		for _, c := range t.dispatchBatch(events) {
+			t.Stop(c)
+		}
+	}
+}
+
+// hit is a watchpoint found on the path of a dispatched event.
+type hit struct {
+	nd    node
+	extra Event
+}
+
+// dispatchBatch looks up the events under a single read lock. It gives
+// oneshot channels, which received any of them and are to be stopped.
+func (t *internalTree) dispatchBatch(events []EventInfo) (fired []chan<- EventInfo) {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	for _, ei := range events {
+		if dbgenabled {
 			dbgprintf("dispatching %v on %q", ei.Event(), ei.Path())
-			go func(ei EventInfo) {
-				nd, ok := node{}, false
-				dir, base := split(ei.Path())
-				fn := func(it node, isbase bool) error {
-					if isbase {
-						nd = it
-					} else {
-						it.Watch.Dispatch(ei, recursive)
-					}
-					return nil
-				}
-				t.rw.RLock()
-				defer t.rw.RUnlock()
-				// Notify recursive watchpoints found on the path.
-				if err := t.root.WalkPath(dir, fn); err != nil {
-					dbgprint("dispatch did not reach leaf:", err)
-					return
-				}
-				// Notify parent watchpoint.
-				nd.Watch.Dispatch(ei, 0)
-				// If leaf watchpoint exists, notify it.
-				if nd, ok = nd.Child[base]; ok {
-					nd.Watch.Dispatch(ei, 0)
-				}
-			}(ei)
 		}
+		fired = append(fired, t.deliver(ei)...)
+		if t.snd.sent == 0 {
+			// Nothing refers to the event any longer.
+			release(ei)
+		}
+	}
+	return fired
+}
+
+// deliver sends ei to every matching watchpoint, with the tree lock held. It
+// gives oneshot channels, which received the event and are to be stopped. The
+// channels are valid until the next call, t.snd.sent gives the number of
+// channels the event was sent to. As deliver is called only by the
+// dispatching goroutine, it reuses t.snd and t.hits.
+func (t *internalTree) deliver(ei EventInfo) []chan<- EventInfo {
+	nd, ok := node{}, false
+	hits := t.hits[:0]
+	t.snd.Reset()
+	dir, base := split(ei.Path())
+	fn := func(it node, isbase bool) error {
+		if isbase {
+			nd = it
+		} else {
+			hits = append(hits, hit{it, recursive})
+		}
+		return nil
+	}
+	// Look for recursive watchpoints found on the path.
+	if err := t.root.WalkPath(dir, fn); err != nil {
+		if dbgenabled {
+			dbgprint("dispatch did not reach leaf:", err)
+		}
+		return nil
+	}
+	// Parent watchpoint.
+	hits = append(hits, hit{nd, 0})
+	// If leaf watchpoint exists, notify it as well.
+	if nd, ok = nd.Child[base]; ok {
+		hits = append(hits, hit{nd, 0})
+	}
+	var total Event
+	for _, h := range hits {
+		total |= h.nd.Watch.Total()
+	}
+	if total&Attrib != 0 {
+		ei = t.stats.Update(ei)
+	}
+	for _, h := range hits {
+		send := t.send
+		if h.extra&recursive != 0 {
+			send = t.depth.Filter(h.nd.Name, dir, send)
+		}
+		h.nd.Watch.Dispatch(ei, h.extra, h.nd.Name, send)
 	}
+	t.hits = hits
+	return t.snd.fired
 }
 
 func (t *internalTree) Exclude(pattern string) error {
@@ -193,7 +269,7 @@ func (t *internalTree) Exclude(pattern string) error {
 
 // Watch TODO(rjeczalik)
 func (t *internalTree) Watch(path string, c chan<- EventInfo,
-	_ DoNotWatchFn, events ...Event) error {
+	o options, events ...Event) (err error) {
 	if c == nil {
 		panic("notify: Watch using nil channel")
 	}
@@ -201,17 +277,53 @@ func (t *internalTree) Watch(path string, c chan<- EventInfo,
 	if len(events) == 0 {
 		return nil
 	}
-	path, isrec, err := cleanpath(path)
+	var alias string
+	if o.alias {
+		alias = aliaspath(path)
+	}
+	clean := cleanpath
+	if o.flags&dontFollow != 0 {
+		clean = cleanlink
+	}
+	path, isrec, err := clean(path)
 	if err != nil {
 		return err
 	}
-	eventset := joinevents(events)
+	eventset := joinevents(events) | o.flags
 	if isrec {
 		eventset |= recursive
 	}
+	var fired []chan<- EventInfo
+	var prime, scan bool
+	defer func() {
+		// The state of files is cached, the initial scan is replayed and
+		// oneshot channels are stopped after the lock is released.
+		if prime {
+			t.stats.Prime(path, isrec, o.doNotWatch)
+		}
+		if scan {
+			fired = append(fired, replay(path, isrec, c, o, t.w, &t.rw, t.subs, t.d.Send)...)
+		}
+		for _, c := range fired {
+			t.Stop(c)
+		}
+	}()
 	t.rw.Lock()
 	defer t.rw.Unlock()
+	defer func() {
+		if err == nil {
+			t.hold.Add(c, path)
+			t.subs.Add(c, o)
+			if alias != "" {
+				t.subs.Alias(c, path, alias)
+			}
+			prime, scan = eventset&Attrib != 0, o.scan
+		}
+	}()
 	cur := t.root.Add(path) // add after the walk, so it's less to traverse
+	if isrec {
+		t.depth.Set(path, c, o.depth, cur.Watch[c]&recursive != 0)
+	}
 
 	if isDone, err := t.curIsChild(path, c, eventset, isrec, cur); isDone {
 		return err
@@ -227,7 +339,7 @@ func (t *internalTree) Watch(path string, c chan<- EventInfo,
 // curIsChild looks for parent watch which already covers the given path. (case 1)
 func (t *internalTree) curIsChild(path string, c chan<- EventInfo, eventset Event, isrec bool, cur node) (bool, error) {
 	var err error
-	parent := node{}
+	var parent node
 	self := false
 	err = t.root.WalkPath(path, func(nd node, isbase bool) error {
 		if watchTotal(nd) != 0 {
@@ -241,7 +353,7 @@ func (t *internalTree) curIsChild(path string, c chan<- EventInfo, eventset Even
 		return true, err
 	}
 	// There are not watches on parent, this case does not apply.
-	if parent.Watch == nil {
+	if parent.entry == nil {
 		return false, nil
 	}
 
@@ -252,6 +364,7 @@ func (t *internalTree) curIsChild(path string, c chan<- EventInfo, eventset Even
 		diff = watchAdd(cur, c, eventset)
 	} else {
 		diff = watchAddInactive(parent, c, eventset)
+		t.hold.Add(c, parent.Name)
 	}
 	switch {
 	case diff == none:
@@ -301,6 +414,14 @@ func (t *internalTree) curIsNewParent(c chan<- EventInfo, eventset Event, cur no
 	for _, nd := range children {
 		watchCopy(nd, cur)
 	}
+	// The watchpoints of the children are held by cur as well.
+	for _, wp := range []watchpoint{cur.Watch, inactive(cur)} {
+		for c := range wp {
+			if c != nil {
+				t.hold.Add(c, cur.Name)
+			}
+		}
+	}
 	// When there is only one child we rewatch.
 	if len(children) == 1 {
 		err = t.w.Rewatch(children[0].Name, cur.Name, watchTotal(children[0]), watchTotal(cur), true)
@@ -310,8 +431,8 @@ func (t *internalTree) curIsNewParent(c chan<- EventInfo, eventset Event, cur no
 
 	if err != nil {
 		// Clean inactive watchpoint. The c chan did not exist before.
-		cur.Child[""] = node{}
-		delete(cur.Watch, c)
+		delete(cur.Child, "")
+		delete(cur.watch(), c)
 		return true, err
 	}
 	// When there is only one child we finish early and do NOT unwatch.
@@ -375,19 +496,58 @@ func (t *internalTree) Stop(c chan<- EventInfo) {
 		return errSkip
 	}
 	t.rw.Lock()
-	e := t.root.Walk("", fn, nil) // TODO: use max root per c
+	var e error
+	done := make(map[string]bool) // paths, which subtrees c was removed from
+	for _, path := range t.hold.Del(c) {
+		if below(done, path) {
+			continue
+		}
+		nd, err := t.root.Get(path)
+		if err != nil {
+			// The node was removed in the meantime.
+			continue
+		}
+		switch err := fn(nd); err {
+		case nil:
+		case errSkip:
+			done[path] = true
+		default:
+			e = nonil(e, err)
+		}
+	}
+	t.subs.Del(c)
+	t.depth.Del(c)
+	t.stats.Prune(func(path string) bool { return wantsAttrib(t.root, path) })
 	t.rw.Unlock()
+	t.d.Flush(c)
 	if e != nil {
 		err = nonil(err, e)
 	}
 	dbgprintf("Stop(%p) error: %v\n", c, err)
 }
 
+// below reports whether any of the ancestors of the path is in the set.
+func below(set map[string]bool, path string) bool {
+	for dir, _ := split(path); dir != ""; dir, _ = split(dir) {
+		if set[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats implements tree interface. Native recursive watches have no
+// directories, which could fail to be watched.
+func (t *internalTree) Stats() Stats {
+	return Stats{Queue: queueStats(t.w)}
+}
+
 // Close shuts down the internalTree and cleans up resources.
 func (t *internalTree) Close() error {
 	t.cancel()
 	err := t.w.Close()
 	close(t.c)
 	t.wg.Wait()
+	t.d.Wait()
 	return err
 }
@@ -12,7 +12,7 @@ import "testing"
 
 func NewRecursiveTreeTest(t *testing.T, tree string) *N {
 	n := newTreeN(t, tree)
-	n.tree = newRecursiveTree(n.spy, n.c)
+	n.tree = newRecursiveTree(n.spy, n.c, config{})
 	t.Cleanup(n.Close)
 	return n
 }
@@ -61,10 +61,34 @@ func cleanpath(path string) (realpath string, isrec bool, err error) {
 	return path, isrec, nil
 }
 
+// cleanlink is like cleanpath, but it does not resolve the last element of
+// the path if it is a symlink.
+func cleanlink(path string) (realpath string, isrec bool, err error) {
+	if strings.HasSuffix(path, "...") {
+		isrec = true
+		path = path[:len(path)-3]
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", false, err
+	}
+	dir, base := filepath.Split(path)
+	if dir, err = canonical(dir); err != nil {
+		return "", false, err
+	}
+	return filepath.Join(dir, base), isrec, nil
+}
+
 // canonical resolves any symlink in the given path and returns it in a clean form.
 // It expects the path to be absolute. It fails to resolve circular symlinks by
 // maintaining a simple iteration limit.
 func canonical(p string) (string, error) {
+	return walklinks(p, nil)
+}
+
+// walklinks works like canonical, but it additionally calls fn, if non-nil,
+// for each symlink it resolves. The parent directory of the symlink passed to
+// fn is already in its canonical form.
+func walklinks(p string, fn func(link string)) (string, error) {
 	p, err := filepath.Abs(p)
 	if err != nil {
 		return "", err
@@ -83,6 +107,9 @@ func canonical(p string) (string, error) {
 			return "", err
 		}
 		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if fn != nil {
+				fn(p[:i])
+			}
 			s, err := os.Readlink(p[:i])
 			if err != nil {
 				return "", err
@@ -133,6 +160,18 @@ func indexrel(root, name string) int {
 	return -1
 }
 
+// rel gives name relative to root. It returns "." if both are equal and name
+// itself if it is not a child of root.
+func rel(root, name string) string {
+	if root == name {
+		return "."
+	}
+	if i := indexrel(root, name); i != -1 {
+		return name[i:]
+	}
+	return name
+}
+
 func indexSep(s string) int {
 	for i := 0; i < len(s); i++ {
 		if s[i] == os.PathSeparator {
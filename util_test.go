@@ -137,6 +137,26 @@ func TestTreeLastIndexSep(t *testing.T) {
 	}
 }
 
+func TestTreeRel(t *testing.T) {
+	cases := [...]struct {
+		root string
+		path string
+		rel  string
+	}{
+		{"/home/rjeczalik", "/home/rjeczalik/src", "src"},
+		{"/home/rjeczalik", "/home/rjeczalik/src/notify/.git", "src/notify/.git"},
+		{"/home/rjeczalik", "/home/rjeczalik", "."},
+		{"/home/rjeczalik", "/home/rjeczalikz/src", "/home/rjeczalikz/src"},
+		{"C:/Documents and Users", "C:/Documents and Users/pblaszczyk", "pblaszczyk"},
+	}
+	for i, cas := range cases {
+		root, path := filepath.FromSlash(cas.root), filepath.FromSlash(cas.path)
+		if rel := rel(root, path); rel != filepath.FromSlash(cas.rel) {
+			t.Errorf("want rel=%s; got %s (i=%d)", cas.rel, rel, i)
+		}
+	}
+}
+
 func TestCleanpath(t *testing.T) {
 	t.Skip("TODO(rjeczalik)")
 }
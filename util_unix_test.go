@@ -123,3 +123,30 @@ func TestCanonical_RelativeSymlink(t *testing.T) {
 		t.Fatalf("want canonical()=%s; got %s", realpath, got)
 	}
 }
+
+func TestWalklinks(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		real = filepath.Join(dir, "..2024_01", "key")
+		data = filepath.Join(dir, "..data")
+		key  = filepath.Join(dir, "key")
+	)
+	if err = nonil(os.MkdirAll(filepath.Dir(real), 0755), os.WriteFile(real, nil, 0644),
+		os.Symlink("..2024_01", data), os.Symlink(filepath.Join("..data", "key"), key)); err != nil {
+		t.Fatal(err)
+	}
+	var links []string
+	p, err := walklinks(key, func(link string) { links = append(links, filepath.Clean(link)) })
+	if err != nil {
+		t.Fatalf("walklinks(%q)=%v", key, err)
+	}
+	if p != real {
+		t.Errorf("want walklinks(%q)=%q; got %q", key, real, p)
+	}
+	if len(links) != 2 || links[0] != key || links[1] != data {
+		t.Errorf("want links=%v; got %v", []string{key, data}, links)
+	}
+}
@@ -103,3 +103,17 @@ func write(w *MockWatcher, path string, p []byte) FileOperation {
 		},
 	}
 }
+
+func chmod(w *MockWatcher, path string, mode os.FileMode) FileOperation {
+	return FileOperation{
+		Action: func() {
+			if err := os.Chmod(filepath.Join(w.root, filepath.FromSlash(path)), mode); err != nil {
+				w.Fatal(err)
+			}
+			dbgprintf("[FS] os.Chmod(%q, %v)\n", path, mode)
+		},
+		Events: []EventInfo{
+			&Call{P: path, E: Attrib},
+		},
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// walkWorkers is the number of goroutines, which read directories at once.
+var walkWorkers = runtime.GOMAXPROCS(0)
+
+// walkParallel is the number of directories, below which AddTree watches
+// them one by one, as the watcher is not worth being called concurrently.
+const walkParallel = 64
+
+// pool calls fn for the items and for the items fn gives, using at most n
+// goroutines at once. It stops at the first error and returns it.
+func pool[T any](n int, items []T, fn func(T) ([]T, error)) error {
+	var (
+		mu      sync.Mutex
+		cond    = sync.NewCond(&mu)
+		pending = len(items)
+		err     error
+		wg      sync.WaitGroup
+	)
+	worker := func() {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			for len(items) == 0 && pending != 0 && err == nil {
+				cond.Wait()
+			}
+			if len(items) == 0 || err != nil {
+				return
+			}
+			it := items[len(items)-1]
+			items = items[:len(items)-1]
+			mu.Unlock()
+			more, e := fn(it)
+			mu.Lock()
+			if e != nil && err == nil {
+				err = e
+			}
+			items = append(items, more...)
+			pending += len(more) - 1
+			cond.Broadcast()
+		}
+	}
+	wg.Add(max(n, 1))
+	for i := 0; i < max(n, 1); i++ {
+		go worker()
+	}
+	wg.Wait()
+	return err
+}
+
+// racy is the granularity of modification times, which directories are
+// assumed to have. Directories modified less than racy before a snapshot was
+// taken may change again without their modification time being changed.
+const racy = 2 * time.Second
+
+// dirtree is a snapshot of a directory subtree, which is read off the tree
+// lock and grafted onto the tree with AddTree.
+type dirtree struct {
+	root node                     // directories of the subtree, detached from the tree
+	sums map[string]dirsum        // digests of the directories by their paths
+	at   time.Time                // when the snapshot was started
+	n    int                      // number of directories
+	ents map[string][]os.DirEntry // entries of the directories, if kept
+}
+
+// dirsum describes a directory of the snapshot.
+type dirsum struct {
+	sum   uint64    // digest of the entry names
+	mtime time.Time // modification time, taken before the entries were read
+}
+
+// clean reports whether the directory did not change since the snapshot was
+// taken, as far as its modification time tells. It is not read then.
+func (dt *dirtree) clean(dir string) bool {
+	ds, ok := dt.sums[dir]
+	if !ok || !ds.mtime.Before(dt.at.Add(-racy)) {
+		return false
+	}
+	fi, err := os.Stat(dir)
+	return err == nil && fi.ModTime().Equal(ds.mtime)
+}
+
+// entries gives the entries of the directory kept by the snapshot, provided
+// the directory did not change since the snapshot was taken.
+func (dt *dirtree) entries(dir string) ([]os.DirEntry, bool) {
+	if dt == nil {
+		return nil, false
+	}
+	entries, ok := dt.ents[dir]
+	return entries, ok && dt.clean(dir)
+}
+
+// digest gives a digest of the names of the entries, which does not depend
+// on their order.
+func digest(entries []os.DirEntry) uint64 {
+	var sum uint64
+	for _, e := range entries {
+		h := fnv.New64a()
+		h.Write([]byte(e.Name()))
+		sum += h.Sum64()
+	}
+	return sum + uint64(len(entries))
+}
+
+// readdir gives the entries of the directory, in the directory order. It
+// relies on os.File.ReadDir for the types of the entries, which takes them
+// from the directory itself where the system reports them.
+func readdir(dir string) ([]os.DirEntry, error) {
+	entries, _, err := readdirTime(dir)
+	return entries, err
+}
+
+// readdirTime works like readdir, but gives also the modification time of the
+// directory, taken before the entries are read.
+func readdirTime(dir string) ([]os.DirEntry, time.Time, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	entries, err := f.ReadDir(-1)
+	return entries, fi.ModTime(), err
+}
+
+// graft makes pre, a node of a snapshot, the child of nd together with its
+// subtree, unless nd already has a child of that name. It gives the child.
+func (nd node) graft(base string, pre node) node {
+	if child, ok := nd.Child[base]; ok {
+		return child
+	}
+	if nd.Child == nil {
+		nd.Child = make(map[string]node)
+	}
+	nd.Child[pre.Name[len(pre.Name)-len(base):]] = pre
+	return pre
+}
+
+// readtree reads the directory subtree of top in parallel. The depth limits
+// the number of directory levels read below top, negative meaning no limit.
+// Directories, which cannot be read, are left out of the snapshot. If pr is
+// cancelled, the snapshot is left incomplete. If keep is true, the entries of
+// the directories are kept in the snapshot as well.
+func readtree(top string, depth int, doNotWatch DoNotWatchFn, pr *progress, keep bool) *dirtree {
+	type item struct {
+		nd    node
+		depth int
+	}
+	var mu sync.Mutex
+	dt := &dirtree{root: newnode(top), sums: make(map[string]dirsum), at: time.Now(), n: 1}
+	if keep {
+		dt.ents = make(map[string][]os.DirEntry)
+	}
+	fn := func(it item) ([]item, error) {
+		if it.depth == 0 {
+			return nil, nil
+		}
+		if err := pr.err(); err != nil {
+			return nil, err
+		}
+		entries, mtime, err := readdirTime(it.nd.Name)
+		if err != nil {
+			return nil, nil
+		}
+		pr.walk()
+		var more []item
+		for _, e := range entries {
+			path := filepath.Join(it.nd.Name, e.Name())
+			if !e.IsDir() || (doNotWatch != nil && doNotWatch(path)) {
+				continue
+			}
+			more = append(more, item{it.nd.addchild(path, e.Name()), max(it.depth-1, -1)})
+		}
+		mu.Lock()
+		dt.sums[it.nd.Name] = dirsum{sum: digest(entries), mtime: mtime}
+		dt.n += len(more)
+		if keep {
+			dt.ents[it.nd.Name] = entries
+		}
+		mu.Unlock()
+		return more, nil
+	}
+	pool(walkWorkers, []item{{dt.root, depth}}, fn)
+	return dt
+}
+
+// AddTree works like AddDir, but the directories are taken from the snapshot
+// dt. The nodes of the snapshot are grafted onto the tree as they are, and
+// only the directories, which changed since the snapshot was taken, are read
+// again. If the snapshot is large enough, fn is called concurrently for
+// different directories.
+//
+// As fn is called for a directory before it is checked for changes, no
+// directory created in the meantime goes unnoticed, provided fn sets a watch.
+//
+// If yield is not nil, the directories are added in rounds of about walkRound
+// of them and yield is called between the rounds. Directories, which vanish
+// in the meantime, are then left out. Adding stops if yield fails.
+func (nd node) AddTree(dt *dirtree, fn walkFunc, doNotWatch DoNotWatchFn, depth int,
+	skip skipFunc, yield func() error) error {
+	type item struct {
+		nd    node
+		pre   node // node of the snapshot, if any
+		depth int
+	}
+	var mu sync.Mutex // serializes skip
+	top := nd.Name
+	// graft gives the children of it, which are taken from the snapshot.
+	graft := func(it item) []item {
+		more := make([]item, 0, len(it.pre.Child))
+		for base, pre := range it.pre.Child {
+			more = append(more, item{it.nd.graft(base, pre), pre, max(it.depth-1, -1)})
+		}
+		return more
+	}
+	visit := func(it item) ([]item, error) {
+		switch err := fn(it.nd); err {
+		case nil:
+		case errSkip:
+			return nil, nil
+		default:
+			if yield != nil && os.IsNotExist(err) && it.nd.Name != top {
+				return nil, nil
+			}
+			if skip != nil && it.nd.Name != top {
+				mu.Lock()
+				skip(it.nd.Name, err)
+				mu.Unlock()
+				return nil, nil
+			}
+			return nil, &os.PathError{
+				Op:   "error while traversing",
+				Path: it.nd.Name,
+				Err:  err,
+			}
+		}
+		if it.depth == 0 {
+			return nil, nil
+		}
+		snap := it.pre.entry != nil && it.pre.Name == it.nd.Name
+		if snap && dt.clean(it.nd.Name) {
+			return graft(it), nil
+		}
+		entries, err := readdir(it.nd.Name)
+		if err != nil {
+			if yield != nil && os.IsNotExist(err) {
+				return nil, nil
+			}
+			if skip != nil {
+				mu.Lock()
+				skip(it.nd.Name, err)
+				mu.Unlock()
+				return nil, nil
+			}
+			return nil, err
+		}
+		if ds, ok := dt.sums[it.nd.Name]; snap && ok && ds.sum == digest(entries) {
+			return graft(it), nil
+		}
+		var more []item
+		for _, e := range entries {
+			path := filepath.Join(it.nd.Name, e.Name())
+			if !e.IsDir() || (doNotWatch != nil && doNotWatch(path)) {
+				continue
+			}
+			var pre node // zero if the directory is missing from the snapshot
+			if it.pre.entry != nil {
+				pre = it.pre.Child[e.Name()]
+			}
+			var child node
+			if pre.entry != nil {
+				child = it.nd.graft(e.Name(), pre)
+			} else {
+				child = it.nd.addchild(path, e.Name())
+			}
+			more = append(more, item{child, pre, max(it.depth-1, -1)})
+		}
+		if it.nd.entry == it.pre.entry && len(it.nd.Child) != len(more) {
+			// The node was grafted, its children, which are gone since
+			// the snapshot was taken, are removed.
+			keep := make(map[string]struct{}, len(more))
+			for _, m := range more {
+				keep[m.nd.Name] = struct{}{}
+			}
+			for base, child := range it.nd.Child {
+				if _, ok := keep[child.Name]; !ok {
+					delete(it.nd.Child, base)
+				}
+			}
+		}
+		return more, nil
+	}
+	n := 1
+	if dt.n >= walkParallel {
+		n = walkWorkers
+	}
+	if yield == nil {
+		return pool(n, []item{{nd, dt.root, depth}}, visit)
+	}
+	items := []item{{nd, dt.root, depth}}
+	for {
+		var (
+			rest []item // directories left for the next round
+			done int
+		)
+		round := func(it item) ([]item, error) {
+			more, err := visit(it)
+			mu.Lock()
+			defer mu.Unlock()
+			if done++; done >= walkRound {
+				rest = append(rest, more...)
+				return nil, err
+			}
+			return more, err
+		}
+		if err := pool(n, items, round); err != nil || len(rest) == 0 {
+			return err
+		}
+		if err := yield(); err != nil {
+			return err
+		}
+		items = rest
+	}
+}
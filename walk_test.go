@@ -0,0 +1,230 @@
+// Copyright (c) 2014-2015 The Notify Authors. All rights reserved.
+// Use of this source code is governed by the MIT license that can be
+// found in the LICENSE file.
+
+package notify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	var mu sync.Mutex
+	var got []int
+	fn := func(i int) ([]int, error) {
+		mu.Lock()
+		got = append(got, i)
+		mu.Unlock()
+		if i < 100 {
+			return []int{2 * i, 2*i + 1}, nil
+		}
+		return nil, nil
+	}
+	if err := pool(4, []int{1}, fn); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 199 {
+		t.Fatalf("want 199 items; got %d", len(got))
+	}
+	errFail := errors.New("fail")
+	fn = func(i int) ([]int, error) {
+		if i == 50 {
+			return nil, errFail
+		}
+		return []int{i + 1}, nil
+	}
+	if err := pool(4, []int{0}, fn); err != errFail {
+		t.Fatalf("want err=%v; got %v", errFail, err)
+	}
+}
+
+func TestNodeAddTree(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	for i := 0; i < walkParallel; i++ {
+		p := filepath.Join(dir, strconv.Itoa(i%8), strconv.Itoa(i))
+		mustT(t, os.MkdirAll(p, 0755))
+		mustT(t, os.WriteFile(filepath.Join(p, "file"), nil, 0644))
+	}
+	dt := readtree(dir, -1, nil, nil, false)
+	if dt.n != walkParallel+9 {
+		t.Fatalf("want %d directories; got %d", walkParallel+9, dt.n)
+	}
+	// Changes made after the snapshot was taken are accounted.
+	mustT(t, os.Mkdir(filepath.Join(dir, "0", "0", "new"), 0755))
+	mustT(t, os.RemoveAll(filepath.Join(dir, "7", "7")))
+
+	var mu sync.Mutex
+	got := make(map[string]bool)
+	fn := func(nd node) error {
+		mu.Lock()
+		got[nd.Name] = true
+		mu.Unlock()
+		return nil
+	}
+	r := root{nd: newnode("")}
+	mustT(t, r.Add(dir).AddTree(dt, fn, nil, -1, nil, nil))
+	want := make(map[string]bool)
+	mustT(t, r.AddDir(dir, func(nd node) error { want[nd.Name] = true; return nil }, nil, -1, nil))
+	if !want[filepath.Join(dir, "0", "0", "new")] || want[filepath.Join(dir, "7", "7")] {
+		t.Fatalf("unexpected directories %v", want)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+}
+
+func TestNodeAddTreeGraft(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	p := func(names ...string) string { return filepath.Join(append([]string{dir}, names...)...) }
+	for _, name := range []string{p("a", "x"), p("b", "y"), p("c")} {
+		mustT(t, os.MkdirAll(name, 0755))
+	}
+	// The directories were modified long enough before the snapshot.
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{p(), p("a"), p("a", "x"), p("b"), p("b", "y"), p("c")} {
+		mustT(t, os.Chtimes(name, old, old))
+	}
+	dt := readtree(dir, -1, nil, nil, false)
+	mustT(t, os.MkdirAll(p("b", "new", "sub"), 0755))
+	mustT(t, os.Remove(p("c")))
+
+	got := make(map[string]bool)
+	fn := func(nd node) error { got[nd.Name] = true; return nil }
+	r := root{nd: newnode("")}
+	mustT(t, r.Add(dir).AddTree(dt, fn, nil, -1, nil, nil))
+	want := map[string]bool{p(): true, p("a"): true, p("a", "x"): true, p("b"): true,
+		p("b", "y"): true, p("b", "new"): true, p("b", "new", "sub"): true}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v; got %v", want, got)
+	}
+	// The unchanged directory is grafted from the snapshot.
+	nd, err := r.Get(p("a"))
+	mustT(t, err)
+	if nd.entry != dt.root.Child["a"].entry {
+		t.Errorf("want %s node to be taken from the snapshot", nd.Name)
+	}
+	if _, err := r.Get(p("c")); err == nil {
+		t.Errorf("want %s node to be removed", p("c"))
+	}
+}
+
+func TestDirtreeEntries(t *testing.T) {
+	dir, _, err := cleanpath(t.TempDir())
+	mustT(t, err)
+	p := func(names ...string) string { return filepath.Join(append([]string{dir}, names...)...) }
+	mustT(t, os.MkdirAll(p("a"), 0755))
+	mustT(t, os.WriteFile(p("a", "file"), nil, 0644))
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{p(), p("a")} {
+		mustT(t, os.Chtimes(name, old, old))
+	}
+	dt := readtree(dir, -1, nil, nil, true)
+	if entries, ok := dt.entries(p("a")); !ok || len(entries) != 1 || entries[0].Name() != "file" {
+		t.Fatalf("want [file] entries of %s; got %v (ok=%t)", p("a"), entries, ok)
+	}
+	// Entries of the directories, which changed since, are not given.
+	mustT(t, os.WriteFile(p("new"), nil, 0644))
+	if entries, ok := dt.entries(p()); ok {
+		t.Fatalf("want no entries of %s; got %v", p(), entries)
+	}
+	if _, ok := readtree(dir, -1, nil, nil, false).entries(p("a")); ok {
+		t.Fatalf("want no entries kept")
+	}
+}
+
+// benchtree creates a tree of dirs directories, each holding files files.
+func benchtree(b *testing.B, dirs, files int) string {
+	b.Helper()
+	dir, _, err := cleanpath(b.TempDir())
+	mustT(b, err)
+	for i := 0; i < dirs; i++ {
+		p := filepath.Join(dir, strconv.Itoa(i%10), strconv.Itoa(i))
+		mustT(b, os.MkdirAll(p, 0755))
+		for j := 0; j < files; j++ {
+			mustT(b, os.WriteFile(filepath.Join(p, strconv.Itoa(j)), nil, 0644))
+		}
+	}
+	return dir
+}
+
+// readdirLstat lists the subdirectories of dir the way AddDir used to, by
+// calling lstat(2) for every entry.
+func readdirLstat(dir string, n *int) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, name := range names {
+		name = filepath.Join(dir, name)
+		fi, err := os.Lstat(name)
+		*n++
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&(os.ModeSymlink|os.ModeDir) == os.ModeDir {
+			dirs = append(dirs, name)
+		}
+	}
+	return dirs, nil
+}
+
+// BenchmarkAddDir and BenchmarkAddDirLstat compare AddDir, which learns the
+// types of the entries from the directories themselves, with listing them
+// by calling lstat(2) for every entry. Both report the directories read and
+// the lstat(2) calls made, as the readdir/op and lstat/op metrics.
+func BenchmarkAddDir(b *testing.B) {
+	dir := benchtree(b, 100, 100)
+	dirs := 0
+	fn := func(node) error { dirs++; return nil }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := root{nd: newnode("")}
+		mustT(b, r.AddDir(dir, fn, nil, -1, nil))
+	}
+	b.ReportMetric(float64(dirs)/float64(b.N), "readdir/op")
+	// AddDir calls lstat(2) for none of the entries.
+	b.ReportMetric(0, "lstat/op")
+}
+
+func BenchmarkAddDirLstat(b *testing.B) {
+	dir := benchtree(b, 100, 100)
+	n, dirs := 0, 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for stack := []string{dir}; len(stack) != 0; dirs++ {
+			more, err := readdirLstat(stack[len(stack)-1], &n)
+			mustT(b, err)
+			stack = append(stack[:len(stack)-1], more...)
+		}
+	}
+	b.ReportMetric(float64(dirs)/float64(b.N), "readdir/op")
+	b.ReportMetric(float64(n)/float64(b.N), "lstat/op")
+}
+
+func BenchmarkReadtree(b *testing.B) {
+	dir := benchtree(b, 1000, 10)
+	defer func(n int) { walkWorkers = n }(walkWorkers)
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run("workers="+strconv.Itoa(n), func(b *testing.B) {
+			walkWorkers = n
+			for i := 0; i < b.N; i++ {
+				readtree(dir, -1, nil, nil, false)
+			}
+		})
+	}
+}
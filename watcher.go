@@ -83,3 +83,30 @@ type watcher interface {
 	// is expected it will report no more events.
 	Close() error
 }
+
+// excluder is implemented by watchers, which support exclusion patterns.
+type excluder interface {
+	// excluded reports whether events of the path are dropped due to any
+	// of the patterns passed to Exclude.
+	excluded(path string) bool
+}
+
+// isExcluded reports whether w excludes events of the path.
+func isExcluded(w watcher, path string) bool {
+	ex, ok := w.(excluder)
+	return ok && ex.excluded(path)
+}
+
+// queuer is implemented by watchers, which queue events read from the system.
+type queuer interface {
+	// queue gives the state of the queue.
+	queue() Queue
+}
+
+// queueStats gives the state of the queue of w, if it has any.
+func queueStats(w watcher) Queue {
+	if q, ok := w.(queuer); ok {
+		return q.queue()
+	}
+	return Queue{}
+}
@@ -134,6 +134,9 @@ func init() {
 		if (e&Create != 0 && dir) || e&Write != 0 {
 			o = (o &^ int64(Write)) | int64(FileModified)
 		}
+		if e&Attrib != 0 {
+			o = (o &^ int64(Attrib)) | int64(FileAttrib)
+		}
 		// Following events are 'exception events' and as such cannot be requested
 		// explicitly for monitoring or filtered out. If the will be reported
 		// by FEN and not subscribed with by user, they will be filtered out by
@@ -147,7 +150,7 @@ func init() {
 		FileRenameFrom: Rename,
 		FileDelete:     Remove,
 		FileAccess:     Event(0),
-		FileAttrib:     Event(0),
+		FileAttrib:     Attrib,
 		FileRenameTo:   Event(0),
 		FileTrunc:      Event(0),
 		FileNoFollow:   Event(0),
@@ -158,5 +161,6 @@ func init() {
 		Write:  FileModified,
 		Rename: FileRenameFrom,
 		Remove: FileDelete,
+		Attrib: FileAttrib,
 	}
 }
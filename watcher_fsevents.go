@@ -20,6 +20,9 @@ const (
 	failure = uint32(FSEventsMustScanSubDirs | FSEventsUserDropped | FSEventsKernelDropped)
 	filter  = uint32(FSEventsCreated | FSEventsRemoved | FSEventsRenamed |
 		FSEventsModified | FSEventsInodeMetaMod)
+	// attrib are the flags reported as Attrib event.
+	attrib = uint32(FSEventsInodeMetaMod | FSEventsChangeOwner | FSEventsXattrMod |
+		FSEventsFinderInfoMod)
 )
 
 // FSEvent represents single file event. It is created out of values passed by
@@ -153,13 +156,16 @@ func (w *watch) Dispatch(ev []FSEvent) {
 			}
 		}
 		// TODO(rjeczalik): get diff only from filtered events?
-		e := w.strip(string(base), ev[i].Flags) & events
-		if e == 0 {
-			continue
-		}
+		set := w.strip(string(base), ev[i].Flags)
+		e := set & events
 		for _, e := range splitflags(e) {
 			w.send(ev[i], e)
 		}
+		// Metadata changes are reported as a single Attrib event, which is
+		// narrowed down by the tree.
+		if set&attrib != 0 && events&uint32(Attrib) != 0 {
+			w.send(ev[i], uint32(Attrib))
+		}
 	}
 }
 
@@ -252,6 +258,16 @@ func (fse *fsevents) Exclude(pattern string) error {
 	return nil
 }
 
+// excluded implements excluder interface.
+func (fse *fsevents) excluded(path string) bool {
+	for v := range maps.Values(fse.exclude) {
+		if v.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // Watch implements Watcher interface. It fails with non-nil error when setting
 // the watch-point by FSEvents fails or with errAlreadyWatched error when
 // the given path is already watched.
@@ -12,9 +12,9 @@ import (
 	"bytes"
 	"errors"
 	"maps"
-	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,37 +23,111 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// eventBufferSize defines the size of the buffer given to read(2) function. One
-// should not depend on this value, since it was arbitrary chosen and may be
-// changed in the future.
+// eventBufferSize defines the initial size of the buffer given to read(2)
+// function. One should not depend on this value, since it was arbitrary chosen
+// and may be changed in the future.
 const eventBufferSize = 64 * (unix.SizeofInotifyEvent + unix.PathMax + 1)
 
+// eventBufferMax is the size, up to which the read buffer grows, while reads
+// fill it up.
+const eventBufferMax = 16 * eventBufferSize
+
+// readShrink is the number of reads in a row, which use less than a quarter of
+// the grown read buffer, after which the buffer is halved.
+const readShrink = 64
+
 // consumersCount defines the number of consumers in producer-consumer based
 // implementation. Each consumer is run in a separate goroutine and has read
-// access to watched files map.
-const consumersCount = 2
+// access to watched files map. There must be exactly one consumer, otherwise
+// batches read from the inotify descriptor could be sent out of order.
+const consumersCount = 1
 
 const invalidDescriptor = -1
 
+// pathCacheSize is the number of paths of recent events, which are reused for
+// the events of the same files.
+const pathCacheSize = 1024
+
 // watched is a pair of file path and inotify mask used as a value in
 // watched files map.
 type watched struct {
-	path string
-	mask uint32
+	path      string
+	mask      uint32
+	unmounted bool // whether IN_UNMOUNT was reported for the watch
 }
 
 // inotify implements Watcher interface.
 type inotify struct {
-	sync.RWMutex                       // protects inotify.m map
-	m            map[int32]*watched    // watch descriptor to watched object
-	fd           int32                 // inotify file descriptor
-	pipefd       []int                 // pipe's read and write descriptors
-	epfd         int                   // epoll descriptor
-	epes         []unix.EpollEvent     // epoll events
-	buffer       [eventBufferSize]byte // inotify event buffer
-	wg           sync.WaitGroup        // wait group used to close main loop
-	c            chan<- EventInfo      // event dispatcher channel
+	sync.RWMutex                    // protects inotify.m map
+	m            map[int32]*watched // watch descriptor to watched object
+	fd           int32              // inotify file descriptor
+	pipefd       []int              // pipe's read and write descriptors
+	epfd         int                // epoll descriptor
+	epes         []unix.EpollEvent  // epoll events
+	buffer       []byte             // inotify event buffer, see adapt
+	small        int                // reads in a row, which used little of buffer
+	wg           sync.WaitGroup     // wait group used to close main loop
+	c            chan<- EventInfo   // event dispatcher channel
 	exclude      map[string]*regexp.Regexp
+	ring         *ring        // batches waiting for the consumer
+	overflows    atomic.Int64 // IN_Q_OVERFLOW events read
+	readSize     atomic.Int64 // len(buffer)
+	// The following are used by the consumer only, they are reused between
+	// batches, so transforming them does not allocate.
+	paths pathCache
+	es    []*event
+	multi []*event
+	lost  []unix.InotifyEvent
+}
+
+// rawEvent is an event read from the inotify descriptor. Its name is held by
+// the batch the event was read into.
+type rawEvent struct {
+	sys        unix.InotifyEvent
+	start, end int // name within readBatch.names
+}
+
+// readBatch holds the events read by a single read(2) call. Batches are taken
+// from batchPool and put back by the consumer, once it transformed them.
+type readBatch struct {
+	raw   []rawEvent
+	names []byte
+}
+
+var batchPool = sync.Pool{New: func() interface{} { return new(readBatch) }}
+
+// name gives the name of r, which is empty for events of the watched
+// directories themselves.
+func (b *readBatch) name(r rawEvent) []byte {
+	return b.names[r.start:r.end]
+}
+
+// pathCache gives the paths of events, reusing the ones it gave recently, so
+// that events of the same files do not allocate their paths.
+type pathCache struct {
+	buf   []byte
+	paths map[string]string
+}
+
+// join works like filepath.Join for a clean dir and a name with no separators.
+func (pc *pathCache) join(dir string, name []byte) string {
+	if len(name) == 0 {
+		return dir
+	}
+	pc.buf = append(pc.buf[:0], dir...)
+	if !strings.HasSuffix(dir, sep) {
+		pc.buf = append(pc.buf, sep...)
+	}
+	pc.buf = append(pc.buf, name...)
+	if path, ok := pc.paths[string(pc.buf)]; ok {
+		return path
+	}
+	if pc.paths == nil || len(pc.paths) >= pathCacheSize {
+		pc.paths = make(map[string]string)
+	}
+	path := string(pc.buf)
+	pc.paths[path] = path
+	return path
 }
 
 // NewWatcher creates new non-recursive inotify backed by inotify.
@@ -104,7 +178,7 @@ func (i *inotify) Rewatch(_ string, path string, _, newevent Event, _ bool) erro
 // one. If called for the first time, this function initializes inotify filesystem
 // monitor and starts producer-consumers goroutines.
 func (i *inotify) watch(path string, e Event) (err error) {
-	if e&^(All|Event(unix.IN_ALL_EVENTS)) != 0 {
+	if e&^(All|Attrib|onlyDir|dontFollow|exclUnlink|Event(unix.IN_ALL_EVENTS)) != 0 {
 		return errors.New("notify: unknown event")
 	}
 	if err = i.lazyinit(); err != nil {
@@ -145,11 +219,11 @@ func (i *inotify) lazyinit() error {
 				i.fd = invalidDescriptor
 				return err
 			}
-			esch := make(chan []*event)
-			go i.loop(esch)
+			i.ring = newRing(ringSize, ringMax)
+			go i.loop(i.ring)
 			i.wg.Add(consumersCount)
 			for n := 0; n < consumersCount; n++ {
-				go i.send(esch)
+				go i.send(i.ring)
 			}
 		}
 	}
@@ -199,10 +273,11 @@ func (i *inotify) epollclose() (err error) {
 }
 
 // loop blocks until either inotify or pipe file descriptor is ready for I/O.
-// All read operations triggered by filesystem notifications are forwarded to
-// one of the event's consumers. If pipe fd became ready, loop function closes
-// all file descriptors opened by lazyinit method and returns afterwards.
-func (i *inotify) loop(esch chan<- []*event) {
+// All read operations triggered by filesystem notifications are queued for
+// the event's consumers, without waiting for them, unless the ring is full.
+// If pipe fd became ready, loop function closes all file descriptors opened
+// by lazyinit method and returns afterwards.
+func (i *inotify) loop(r *ring) {
 	epes := make([]unix.EpollEvent, 1)
 	fd := atomic.LoadInt32(&i.fd)
 	for {
@@ -210,7 +285,12 @@ func (i *inotify) loop(esch chan<- []*event) {
 		case nil:
 			switch epes[0].Fd {
 			case fd:
-				esch <- i.read()
+				b := batchPool.Get().(*readBatch)
+				if i.read(b); len(b.raw) == 0 {
+					batchPool.Put(b)
+				} else {
+					r.Push(b)
+				}
 				epes[0].Fd = 0
 			case int32(i.pipefd[0]):
 				i.Lock()
@@ -222,7 +302,7 @@ func (i *inotify) loop(esch chan<- []*event) {
 				if err = i.epollclose(); err != nil && err != unix.EINTR {
 					panic("notify: epollclose error " + err.Error())
 				}
-				close(esch)
+				r.Close()
 				return
 			}
 		case unix.EINTR:
@@ -233,90 +313,186 @@ func (i *inotify) loop(esch chan<- []*event) {
 	}
 }
 
-// read reads events from an inotify file descriptor. It does not handle errors
-// returned from read(2) function since they are not critical to watcher logic.
-func (i *inotify) read() (es []*event) {
-	n, err := unix.Read(int(i.fd), i.buffer[:])
+// read reads events from an inotify file descriptor into the batch. It does
+// not handle errors returned from read(2) function since they are not critical
+// to watcher logic.
+func (i *inotify) read(b *readBatch) {
+	b.raw, b.names = b.raw[:0], b.names[:0]
+	if i.buffer == nil {
+		i.resize(eventBufferSize)
+	}
+	n, err := unix.Read(int(i.fd), i.buffer)
 	if err != nil || n < unix.SizeofInotifyEvent {
 		return
 	}
 	var sys *unix.InotifyEvent
 	nmin := n - unix.SizeofInotifyEvent
-	for pos, path := 0, ""; pos <= nmin; {
+	for pos := 0; pos <= nmin; {
 		sys = (*unix.InotifyEvent)(unsafe.Pointer(&i.buffer[pos]))
 		pos += unix.SizeofInotifyEvent
-		if path = ""; sys.Len > 0 {
-			endpos := pos + int(sys.Len)
-			path = string(bytes.TrimRight(i.buffer[pos:endpos], "\x00"))
-			pos = endpos
-		}
-		es = append(es, &event{
+		r := rawEvent{
 			sys: unix.InotifyEvent{
 				Wd:     sys.Wd,
 				Mask:   sys.Mask,
 				Cookie: sys.Cookie,
 			},
-			path: path,
-		})
+			start: len(b.names),
+		}
+		if sys.Len > 0 {
+			endpos := pos + int(sys.Len)
+			b.names = append(b.names, bytes.TrimRight(i.buffer[pos:endpos], "\x00")...)
+			pos = endpos
+		}
+		r.end = len(b.names)
+		b.raw = append(b.raw, r)
+	}
+	i.adapt(n)
+}
+
+// adapt resizes the read buffer after a read of n bytes. The buffer grows if
+// the read filled it up, as more events are likely pending, and shrinks back
+// once reads use little of it for a while.
+func (i *inotify) adapt(n int) {
+	switch size := len(i.buffer); {
+	case n > size-(unix.SizeofInotifyEvent+unix.PathMax+1) && size < eventBufferMax:
+		i.resize(min(2*size, eventBufferMax))
+	case n < size/4 && size > eventBufferSize:
+		if i.small++; i.small >= readShrink {
+			i.resize(max(size/2, eventBufferSize))
+		}
+	default:
+		i.small = 0
 	}
-	return
+}
+
+func (i *inotify) resize(size int) {
+	i.buffer, i.small = make([]byte, size), 0
+	i.readSize.Store(int64(size))
+}
+
+// queue implements queuer.
+func (i *inotify) queue() Queue {
+	q := Queue{
+		Overflows: int(i.overflows.Load()),
+		ReadSize:  int(i.readSize.Load()),
+	}
+	i.RLock()
+	r := i.ring
+	i.RUnlock()
+	if r != nil {
+		r.Stats(&q)
+	}
+	return q
 }
 
 // send is a consumer function which sends events to event dispatcher channel.
 // It is run in a separate goroutine in order to not block loop method when
 // possibly expensive write operations are performed on inotify map.
-func (i *inotify) send(esch <-chan []*event) {
-	for es := range esch {
-		for _, e := range i.transform(es) {
-			if e != nil && i.shouldSend(e) {
+//
+// Events sent to the channel are owned by the tree, which releases the ones
+// it did not pass on, so they are reused.
+func (i *inotify) send(r *ring) {
+	for {
+		b, ok := r.Pop()
+		if !ok {
+			break
+		}
+		for _, e := range i.transform(b) {
+			if i.shouldSend(e) {
 				i.c <- e
+			} else {
+				e.release()
 			}
 		}
+		batchPool.Put(b)
 	}
 	i.wg.Done()
 }
 
 func (i *inotify) shouldSend(e *event) bool {
-	shouldSend := true
+	if i.excluded(e.path) {
+		dbgprintf("will exclude event: %v", e.String())
+		return false
+	}
+	return true
+}
+
+// excluded implements excluder interface.
+func (i *inotify) excluded(path string) bool {
 	for v := range maps.Values(i.exclude) {
-		if v.MatchString(e.path) {
-			dbgprintf("will exclude event: %v", e.String())
-			shouldSend = false
-			break
+		if v.MatchString(path) {
+			return true
 		}
 	}
-	return len(i.exclude) == 0 || shouldSend
+	return false
 }
 
 // transform prepares events read from inotify file descriptor for sending to
 // user. It removes invalid events and these which are no longer present in
 // inotify map. This method may also split one raw event into two different ones
-// when system-dependent result is required.
-func (i *inotify) transform(es []*event) []*event {
-	var multi []*event
+// when system-dependent result is required. The returned slice is valid until
+// the next call.
+func (i *inotify) transform(b *readBatch) []*event {
+	es, multi, lost := i.es[:0], i.multi[:0], i.lost[:0]
 	i.RLock()
-	for idx, e := range es {
-		if e.sys.Mask&(unix.IN_IGNORED|unix.IN_Q_OVERFLOW) != 0 {
-			es[idx] = nil
+	for _, r := range b.raw {
+		if r.sys.Mask&(unix.IN_IGNORED|unix.IN_UNMOUNT) != 0 {
+			lost = append(lost, r.sys)
+			continue
+		}
+		if r.sys.Mask&unix.IN_Q_OVERFLOW != 0 {
+			i.overflows.Add(1)
 			continue
 		}
-		wd, ok := i.m[e.sys.Wd]
-		if !ok || e.sys.Mask&encode(Event(wd.mask)) == 0 {
-			es[idx] = nil
+		wd, ok := i.m[r.sys.Wd]
+		if !ok || r.sys.Mask&encode(Event(wd.mask)) == 0 {
 			continue
 		}
-		if e.path == "" {
-			e.path = wd.path
-		} else {
-			e.path = filepath.Join(wd.path, e.path)
+		e := newEvent()
+		e.sys, e.path = r.sys, i.paths.join(wd.path, b.name(r))
+		if syse := decode(Event(wd.mask), e); syse != nil {
+			multi = append(multi, syse)
 		}
-		multi = append(multi, decode(Event(wd.mask), e))
 		if e.event == 0 {
-			es[idx] = nil
+			e.release()
+			continue
 		}
+		es = append(es, e)
 	}
 	i.RUnlock()
-	es = append(es, multi...)
+	es = i.removed(append(es, multi...), lost)
+	i.es, i.multi, i.lost = es, multi, lost
+	return es
+}
+
+// removed removes watches, which were dropped by the kernel, from inotify map.
+// It turns IN_IGNORED events of these watches into WatchRemoved events or, if
+// the watched filesystem was unmounted, into Unmounted ones, and appends them
+// to es. Watches removed by Unwatch are no longer present in the map, so they
+// are not reported.
+func (i *inotify) removed(es []*event, lost []unix.InotifyEvent) []*event {
+	if len(lost) == 0 {
+		return es
+	}
+	i.Lock()
+	for _, sys := range lost {
+		wd, ok := i.m[sys.Wd]
+		if !ok {
+			continue
+		}
+		if sys.Mask&unix.IN_UNMOUNT != 0 {
+			wd.unmounted = true
+			continue
+		}
+		delete(i.m, sys.Wd)
+		e := newEvent()
+		e.sys, e.path, e.event, e.timestamp = sys, wd.path, WatchRemoved, time.Now().Unix()
+		if wd.unmounted {
+			e.event = Unmounted
+		}
+		es = append(es, e)
+	}
+	i.Unlock()
 	return es
 }
 
@@ -335,6 +511,15 @@ func encode(e Event) uint32 {
 	if e&Rename != 0 {
 		e = (e ^ Rename) | InMovedFrom | InMoveSelf
 	}
+	if e&Attrib != 0 {
+		e = (e &^ Attrib) | InAttrib
+	}
+	if e&onlyDir != 0 {
+		e = (e ^ onlyDir) | Event(unix.IN_ONLYDIR)
+	}
+	if e&dontFollow != 0 {
+		e = (e ^ dontFollow) | Event(unix.IN_DONT_FOLLOW)
+	}
 	return uint32(e)
 }
 
@@ -342,10 +527,12 @@ func encode(e Event) uint32 {
 // or system-dependent event is requested. The first one is created by modifying
 // `e` argument. decode method sets e.event value to 0 when an event should be
 // skipped. System-dependent event is set as the function's return value which
-// can be nil when the event should not be passed on.
+// can be nil when the event should not be passed on. Metadata changes are
+// reported as Attrib, it is up to the tree to narrow them down.
 func decode(mask Event, e *event) (syse *event) {
 	if sysmask := uint32(mask) & e.sys.Mask; sysmask != 0 {
-		syse = &event{
+		syse = newEvent()
+		*syse = event{
 			sys: unix.InotifyEvent{
 				Wd:     e.sys.Wd,
 				Mask:   e.sys.Mask,
@@ -365,6 +552,8 @@ func decode(mask Event, e *event) (syse *event) {
 		e.event = Write
 	case mask&Rename != 0 && imask&uint32(InMovedFrom|InMoveSelf)&e.sys.Mask != 0:
 		e.event = Rename
+	case mask&Attrib != 0 && imask&uint32(InAttrib)&e.sys.Mask != 0:
+		e.event = Attrib
 	default:
 		e.event = 0
 	}
@@ -8,9 +8,16 @@
 package notify
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 func icreate(w *MockWatcher, path string) FileOperation {
@@ -131,3 +138,174 @@ func TestWatcherInotify(t *testing.T) {
 
 	w.ExpectAny(cases[:])
 }
+
+// rawInotify encodes the events the way read(2) gives them, each of them for
+// the watch descriptor 1.
+func rawInotify(mask uint32, names ...string) []byte {
+	var p []byte
+	for _, name := range names {
+		n := 0
+		if name != "" {
+			n = (len(name) + 16) &^ 15 // NUL-terminated and padded
+		}
+		sys := unix.InotifyEvent{Wd: 1, Mask: mask, Len: uint32(n)}
+		p = append(p, (*[unix.SizeofInotifyEvent]byte)(unsafe.Pointer(&sys))[:]...)
+		p = append(p, name...)
+		p = append(p, make([]byte, n-len(name))...)
+	}
+	return p
+}
+
+// pipeInotify gives an inotify, which reads events from a pipe instead of an
+// inotify descriptor, and the write end of the pipe.
+func pipeInotify(t testing.TB, mask Event) (*inotify, int) {
+	var fds [2]int
+	mustT(t, unix.Pipe(fds[:]))
+	t.Cleanup(func() { unix.Close(fds[0]); unix.Close(fds[1]) })
+	i := &inotify{
+		m:  map[int32]*watched{1: {path: "/srv/data", mask: uint32(mask)}},
+		fd: int32(fds[0]),
+	}
+	return i, fds[1]
+}
+
+func TestInotifyRead(t *testing.T) {
+	i, w := pipeInotify(t, Create|Write)
+	_, err := unix.Write(w, append(rawInotify(unix.IN_MODIFY, "file", "", "a-longer-name"),
+		rawInotify(unix.IN_DELETE, "file")...))
+	mustT(t, err)
+	b := batchPool.Get().(*readBatch)
+	i.read(b)
+	es := i.transform(b)
+	want := []string{"/srv/data/file", "/srv/data", "/srv/data/a-longer-name"}
+	if len(es) != len(want) {
+		t.Fatalf("want %d events; got %d", len(want), len(es))
+	}
+	for n, e := range es {
+		if e.Event() != Write || e.Path() != want[n] {
+			t.Errorf("want Write on %s; got %v", want[n], e)
+		}
+	}
+	// Paths of the same files are reused.
+	if p := i.paths.join("/srv/data", []byte("file")); unsafe.StringData(p) != unsafe.StringData(es[0].Path()) {
+		t.Errorf("want the path of %q reused", p)
+	}
+}
+
+// BenchmarkInotifyRead measures reading and transforming a batch of 64 events
+// of 16 files, which are not passed on to any channel, so they are released
+// by the tree.
+func BenchmarkInotifyRead(b *testing.B) {
+	i, w := pipeInotify(b, Create|Write)
+	names := make([]string, 64)
+	for n := range names {
+		names[n] = "file" + strconv.Itoa(n%16)
+	}
+	p := rawInotify(unix.IN_MODIFY, names...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := unix.Write(w, p); err != nil {
+			b.Fatal(err)
+		}
+		batch := batchPool.Get().(*readBatch)
+		i.read(batch)
+		for _, e := range i.transform(batch) {
+			e.release()
+		}
+		batchPool.Put(batch)
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(names)), "ns/event")
+}
+
+func TestRing(t *testing.T) {
+	batch := func(n int) *readBatch { return &readBatch{raw: make([]rawEvent, n)} }
+	r := newRing(2, 8)
+	var want []*readBatch
+	for n := 0; n < 8; n++ {
+		want = append(want, batch(1))
+		if !r.Push(want[n]) {
+			t.Fatal("want Push to succeed")
+		}
+		if n == 1 {
+			// Wrap the ring around before it grows.
+			b, _ := r.Pop()
+			r.Push(b)
+			want = append(want[1:], b)
+		}
+	}
+	var q Queue
+	if r.Stats(&q); q.Len != 8 || q.Batches != 8 || q.Cap != 8 || q.Stalls != 0 {
+		t.Fatalf("want 8 events in 8 batches of 8; got %+v", q)
+	}
+	// The ring is full, so the next batch waits for the consumer.
+	pushed := make(chan bool)
+	go func() { pushed <- r.Push(batch(2)) }()
+	for r.Stats(&q); q.Stalls == 0; r.Stats(&q) {
+		runtime.Gosched()
+	}
+	for n := 0; n < 2; n++ {
+		if b, ok := r.Pop(); !ok || b != want[n] {
+			t.Fatalf("want batch %d popped in order", n)
+		}
+	}
+	if !<-pushed {
+		t.Fatal("want Push to succeed")
+	}
+	if r.Stats(&q); q.Len != 8 || q.Peak != 8 || q.Stalls != 1 {
+		t.Fatalf("want 8 events after a single stall; got %+v", q)
+	}
+	r.Close()
+	if _, ok := r.Pop(); ok {
+		t.Fatal("want Pop to fail after Close")
+	}
+	if r.Push(batch(1)) {
+		t.Fatal("want Push to fail after Close")
+	}
+}
+
+// TestInotifyQueue checks the kernel queue is drained, while the events are
+// not received, so it does not overflow.
+func TestInotifyQueue(t *testing.T) {
+	n := 20000
+	if b, err := os.ReadFile("/proc/sys/fs/inotify/max_queued_events"); err == nil {
+		if max, err := strconv.Atoi(string(bytes.TrimSpace(b))); err == nil && max >= n {
+			n = max + 1000
+		}
+	}
+	dir := t.TempDir()
+	c := make(chan EventInfo)
+	w := newWatcher(c).(*inotify)
+	defer w.Close()
+	mustT(t, w.Watch(dir, Create, false))
+	wait := func(what string, ok func(q Queue) bool) {
+		t.Helper()
+		for timeout := time.After(10 * time.Second); !ok(w.queue()); {
+			select {
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s: %+v", what, w.queue())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	// The consumer takes the first event and waits to send it.
+	mustT(t, os.WriteFile(filepath.Join(dir, "first"), nil, 0644))
+	wait("the first event", func(q Queue) bool { return q.Peak == 1 && q.Batches == 0 })
+	for k := 0; k < n; k++ {
+		mustT(t, os.WriteFile(filepath.Join(dir, strconv.Itoa(k)), nil, 0644))
+	}
+	wait("the events to be read", func(q Queue) bool { return q.Len == n })
+	for k := 0; k <= n; k++ {
+		select {
+		case ei := <-c:
+			if ei.Event() != Create {
+				t.Fatalf("want Create; got %v", ei)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the event %d of %d: %+v", k, n+1, w.queue())
+		}
+	}
+	if q := w.queue(); q.Overflows != 0 || q.Len != 0 || q.ReadSize < eventBufferSize {
+		t.Fatalf("want no overflows and no events queued; got %+v", q)
+	}
+}
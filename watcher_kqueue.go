@@ -177,6 +177,9 @@ func init() {
 		if (e&Create != 0 && dir) || e&Write != 0 {
 			o = (o &^ int64(Write)) | int64(NoteWrite)
 		}
+		if e&Attrib != 0 {
+			o = (o &^ int64(Attrib)) | int64(NoteAttrib)
+		}
 		if e&Rename != 0 {
 			o = (o &^ int64(Rename)) | int64(NoteRename)
 		}
@@ -190,7 +193,7 @@ func init() {
 		NoteRename: Rename,
 		NoteDelete: Remove,
 		NoteExtend: Event(0),
-		NoteAttrib: Event(0),
+		NoteAttrib: Attrib,
 		NoteRevoke: Event(0),
 		NoteLink:   Event(0),
 	}
@@ -198,5 +201,6 @@ func init() {
 		Write:  NoteWrite,
 		Rename: NoteRename,
 		Remove: NoteDelete,
+		Attrib: NoteAttrib,
 	}
 }
@@ -149,6 +149,10 @@ func encode(filter uint32) uint32 {
 	if e&Rename != 0 {
 		e = (e ^ Rename) | FileNotifyChangeFileName
 	}
+	if e&Attrib != 0 {
+		e = (e &^ Attrib) | FileNotifyChangeAttributes | FileNotifyChangeLastWrite |
+			FileNotifyChangeSecurity
+	}
 	return uint32(e)
 }
 
@@ -290,7 +294,7 @@ func (r *readdcw) Watch(path string, event Event, isrec bool) error {
 // already exists, function tries to rewatch it with new filters(NOT VALID). Moreover,
 // watch starts the main event loop goroutine when called for the first time.
 func (r *readdcw) watch(path string, event Event, recursive bool) error {
-	if event&^(All|fileNotifyChangeAll) != 0 {
+	if event&^(All|Attrib|fileNotifyChangeAll) != 0 {
 		return errors.New("notify: unknown event")
 	}
 
@@ -464,7 +468,7 @@ func (r *readdcw) Rewatch(oldPath, newPath string, oldevent, newevent Event, isr
 
 // TODO : (pknap) doc.
 func (r *readdcw) rewatch(path string, oldevent, newevent uint32, recursive bool) (err error) {
-	if Event(newevent)&^(All|fileNotifyChangeAll) != 0 {
+	if Event(newevent)&^(All|Attrib|fileNotifyChangeAll) != 0 {
 		return errors.New("notify: unknown event")
 	}
 	var wd *watched
@@ -564,6 +568,9 @@ func (r *readdcw) Close() (err error) {
 // returned from completion routine. Function may return Event(0) in case when
 // filter was replaced by a new value which does not contain fields that are
 // valid with passed action.
+//
+// ReadDirectoryChangesW does not tell a content change from a metadata one,
+// thus modification is reported as Attrib only if Write is not watched.
 func decode(filter, action uint32) (Event, Event) {
 	switch action {
 	case syscall.FILE_ACTION_ADDED:
@@ -571,6 +578,9 @@ func decode(filter, action uint32) (Event, Event) {
 	case syscall.FILE_ACTION_REMOVED:
 		return gensys(filter, Remove, FileActionRemoved)
 	case syscall.FILE_ACTION_MODIFIED:
+		if filter&uint32(Write) == 0 && filter&uint32(Attrib) != 0 {
+			return gensys(filter, Attrib, FileActionModified)
+		}
 		return gensys(filter, Write, FileActionModified)
 	case syscall.FILE_ACTION_RENAMED_OLD_NAME:
 		return gensys(filter, Rename, FileActionRenamedOldName)
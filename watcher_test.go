@@ -37,6 +37,19 @@ func TestWatcher(t *testing.T) {
 	w.ExpectAny(cases[:])
 }
 
+func TestWatcherAttrib(t *testing.T) {
+	w := NewWatcherTest(t, "testdata/vfs.txt", Attrib)
+	defer w.Close()
+
+	cases := [...]FileOperation{
+		chmod(w, "src/github.com/rjeczalik/fs/fs.go", 0600),
+		chmod(w, "src/github.com/rjeczalik/fs/fs.go", 0644),
+		chmod(w, "src/github.com/ppknap/link/README.md", 0600),
+	}
+
+	w.ExpectAny(cases[:])
+}
+
 func TestWatcherExclude(t *testing.T) {
 	w := NewWatcherTest(t, "testdata/vfs.txt")
 	defer w.Close()
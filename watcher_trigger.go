@@ -353,6 +353,9 @@ func (t *trg) dir(w *watched, n interface{}, e, ge Event) (evn []event) {
 		default:
 		}
 	}
+	if e&Attrib != 0 {
+		evn = append(evn, event{w.p, e & Attrib, true, n})
+	}
 	return
 }
 
@@ -4,6 +4,11 @@
 
 package notify
 
+import (
+	"sort"
+	"sync"
+)
+
 // EventDiff describes a change to an event set - EventDiff[0] is an old state,
 // while EventDiff[1] is a new state. If event set has not changed (old == new),
 // functions typically return the None value.
@@ -22,6 +27,77 @@ func (diff eventDiff) Event() Event {
 // for a Watcher implementation which is not natively recursive.
 type watchpoint map[chan<- EventInfo]Event
 
+// sharedWatchpoints interns watchpoints, which hold nothing but the events of
+// a single channel, so that nodes carrying the same one share its map. Shared
+// maps are never written to, see node.watch.
+type sharedWatchpoints struct {
+	c  chan<- EventInfo
+	mu sync.Mutex // protects m
+	m  map[Event]watchpoint
+}
+
+func newSharedWatchpoints(c chan<- EventInfo) *sharedWatchpoints {
+	return &sharedWatchpoints{c: c, m: make(map[Event]watchpoint)}
+}
+
+// Get gives the shared watchpoint holding the events e of the channel.
+func (s *sharedWatchpoints) Get(e Event) watchpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wp, ok := s.m[e]
+	if !ok {
+		wp = watchpoint{s.c: e, nil: e &^ omit}
+		s.m[e] = wp
+	}
+	return wp
+}
+
+// holders maps channels to the paths of the nodes, which hold their
+// watchpoints, so that Stop visits only the subtrees of these nodes. It is
+// guarded by the tree lock. The nodes may be removed from the tree in the
+// meantime, Stop skips their paths then.
+type holders map[chan<- EventInfo]map[string]struct{}
+
+// Add records that the node of the path holds a watchpoint of c.
+func (h holders) Add(c chan<- EventInfo, path string) {
+	paths, ok := h[c]
+	if !ok {
+		paths = make(map[string]struct{})
+		h[c] = paths
+	}
+	paths[path] = struct{}{}
+}
+
+// Del forgets c and gives the paths of the nodes holding its watchpoints,
+// sorted, so that every path comes after its ancestors.
+func (h holders) Del(c chan<- EventInfo) []string {
+	paths := make([]string, 0, len(h[c]))
+	for path := range h[c] {
+		paths = append(paths, path)
+	}
+	delete(h, c)
+	sort.Strings(paths)
+	return paths
+}
+
+// Forget removes the path from the paths of c, together with the paths for
+// which held reports false. It reports whether c is left with any path, c is
+// forgotten otherwise.
+func (h holders) Forget(c chan<- EventInfo, path string, held func(string) bool) bool {
+	paths := h[c]
+	delete(paths, path)
+	for p := range paths {
+		if !held(p) {
+			delete(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		delete(h, c)
+		return false
+	}
+	return true
+}
+
 // None is an empty event diff, think null object.
 var none eventDiff
 
@@ -78,18 +154,21 @@ func (wp watchpoint) Del(c chan<- EventInfo, e Event) (diff eventDiff) {
 	return
 }
 
-func (wp watchpoint) Dispatch(ei EventInfo, extra Event) {
+// Dispatch passes ei to send for every channel whose event set matches it.
+// The root is the path of the node holding the watchpoint, ei is matched
+// against it before it is sent.
+func (wp watchpoint) Dispatch(ei EventInfo, extra Event, root string, send sendFunc) {
 	e := eventmask(ei, extra)
 	if !matches(wp[nil], e) {
 		return
 	}
+	var m *matched
 	for ch, eset := range wp {
 		if ch != nil && matches(eset, e) {
-			select {
-			case ch <- ei:
-			default: // Drop event if receiver is too slow
-				dbgprintf("dropped %s on %q: receiver too slow", ei.Event(), ei.Path())
+			if m == nil {
+				m = newMatched(ei, root)
 			}
+			send(ch, m)
 		}
 	}
 }